@@ -1,20 +1,33 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+const apiKeyPrefix = "sk_live_"
+
+// APIKeyIDKey holds the ID of the API key a request authenticated with. It
+// is unset for requests authenticated with a login token.
+const APIKeyIDKey contextKey = "apiKeyID"
+
 // APIKeyResponse is for fetching an existing key's metadata
 type APIKeyResponse struct {
 	LastFour string `json:"last_four"`
 	Exists   bool   `json:"exists"` // Let the frontend know if a key has been generated yet
+	// Priority is the job priority for uploads made with the key that do not
+	// ask for one, empty when unset.
+	Priority string `json:"priority,omitempty"`
 }
 
 // NewAPIKeyResponse is for generating a new key
@@ -38,7 +51,7 @@ func GenerateAPIKeyHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
 			return
 		}
-		newKey := "sk_live_" + base64.URLEncoding.EncodeToString(randomBytes)
+		newKey := apiKeyPrefix + base64.URLEncoding.EncodeToString(randomBytes)
 
 		// 2. Hash the key for secure storage in the database
 		hashedKey, err := bcrypt.GenerateFromPassword([]byte(newKey), bcrypt.DefaultCost)
@@ -50,12 +63,13 @@ func GenerateAPIKeyHandler(db *sql.DB) http.HandlerFunc {
 		// 3. --- FIX: Store the last four digits along with the hash ---
 		lastFour := newKey[len(newKey)-4:]
 
-		// 4. Store the hashed key and last four, replacing any old key (UPSERT)
+		// 4. Store the hashed key, its lookup hash and last four, replacing any
+		// old key (UPSERT). The key's priority carries over to the new key.
 		query := `
-        INSERT INTO api_keys (user_id, key_hash, last_four) VALUES ($1, $2, $3)
-        ON CONFLICT (user_id) DO UPDATE SET key_hash = EXCLUDED.key_hash, last_four = EXCLUDED.last_four;
+        INSERT INTO api_keys (user_id, key_hash, key_lookup, last_four) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id) DO UPDATE SET key_hash = EXCLUDED.key_hash, key_lookup = EXCLUDED.key_lookup, last_four = EXCLUDED.last_four;
         `
-		if _, err := db.Exec(query, int(userID), string(hashedKey), lastFour); err != nil {
+		if _, err := db.Exec(query, int(userID), string(hashedKey), apiKeyLookup(newKey), lastFour); err != nil {
 			log.Printf("Failed to save API key hash: %v", err)
 			http.Error(w, "Failed to save API key", http.StatusInternalServerError)
 			return
@@ -79,8 +93,9 @@ func GetAPIKeyHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		var lastFour string
-		query := "SELECT last_four FROM api_keys WHERE user_id = $1"
-		err := db.QueryRow(query, int(userID)).Scan(&lastFour)
+		var priority sql.NullString
+		query := "SELECT last_four, priority FROM api_keys WHERE user_id = $1"
+		err := db.QueryRow(query, int(userID)).Scan(&lastFour, &priority)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -95,6 +110,94 @@ func GetAPIKeyHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(APIKeyResponse{LastFour: lastFour, Exists: true})
+		json.NewEncoder(w).Encode(APIKeyResponse{LastFour: lastFour, Exists: true, Priority: priority.String})
 	}
 }
+
+// SetAPIKeyPriorityHandler handles PUT /keys with a JSON body such as
+// {"priority": "low"}. Uploads made with the key that do not ask for a
+// priority get the key's, which lets an integration doing bulk imports stay
+// out of the way of interactive uploads. An empty priority clears it.
+func SetAPIKeyPriorityHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Invalid user ID in token", http.StatusInternalServerError)
+			return
+		}
+
+		var body struct {
+			Priority string `json:"priority"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		priority := strings.ToLower(strings.TrimSpace(body.Priority))
+		if priority != "" && !Priorities[priority] {
+			http.Error(w, "priority must be high, normal or low", http.StatusBadRequest)
+			return
+		}
+
+		var lastFour string
+		query := "UPDATE api_keys SET priority = NULLIF($1, '') WHERE user_id = $2 RETURNING last_four"
+		err := db.QueryRow(query, priority, int(userID)).Scan(&lastFour)
+		if err == sql.ErrNoRows {
+			http.Error(w, "No API key exists", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to set API key priority: %v", err)
+			http.Error(w, "Failed to update API key", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIKeyResponse{LastFour: lastFour, Exists: true, Priority: priority})
+	}
+}
+
+// APIKeyMiddleware authenticates requests sending an API key as
+// "Authorization: Bearer sk_live_..." and hands every other request to
+// JWTMiddleware. Keys generated before key_lookup existed cannot be found
+// and must be regenerated.
+func APIKeyMiddleware(next http.HandlerFunc, db *sql.DB, jwtSecret string) http.HandlerFunc {
+	jwtNext := JWTMiddleware(next, jwtSecret)
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+			jwtNext(w, r)
+			return
+		}
+
+		var keyID, userID int
+		var keyHash string
+		query := "SELECT id, user_id, key_hash FROM api_keys WHERE key_lookup = $1"
+		err := db.QueryRow(query, apiKeyLookup(key)).Scan(&keyID, &userID, &keyHash)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to look up API key: %v", err)
+			http.Error(w, "Failed to check API key", http.StatusInternalServerError)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(keyHash), []byte(key)) != nil {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		// Handlers expect the user ID as a JSON number, like a JWT claim.
+		ctx := context.WithValue(r.Context(), UserIDKey, float64(userID))
+		ctx = context.WithValue(ctx, APIKeyIDKey, keyID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// apiKeyLookup is the indexed SHA-256 of a key, used to find its row. The
+// bcrypt hash is still what verifies it.
+func apiKeyLookup(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
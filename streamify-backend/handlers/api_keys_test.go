@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testAPIKey = apiKeyPrefix + "test-key"
+
+// newAPIKeyDB returns a database holding testAPIKey as key 5 of user 1, with
+// the given priority.
+func newAPIKeyDB(t *testing.T, priority string) (*fakeDB, http.HandlerFunc) {
+	t.Helper()
+	withUploadDir(t)
+	db, fake := newFakeDB(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte(testAPIKey), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.setRows("SELECT id, user_id, key_hash FROM api_keys", []driver.Value{int64(5), int64(1), string(hash)})
+	fake.setRows("SELECT priority FROM api_keys", []driver.Value{priority})
+	return fake, APIKeyMiddleware(UploadHandler(db), db, "jwt-secret")
+}
+
+func uploadWithKey(t *testing.T, handler http.HandlerFunc, key, priority string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if priority != "" {
+		mw.WriteField("priority", priority)
+	}
+	part, _ := mw.CreateFormFile("file", "clip.mp4")
+	part.Write([]byte("video"))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// queuedPriority returns the priority of the only job in the outbox.
+func queuedPriority(t *testing.T, fake *fakeDB) string {
+	t.Helper()
+	jobs := fake.execsLike("INSERT INTO job_outbox")
+	if len(jobs) != 1 {
+		t.Fatalf("%d jobs queued, want 1", len(jobs))
+	}
+	var job VideoJob
+	if err := json.Unmarshal(jobs[0].Args[1].([]byte), &job); err != nil {
+		t.Fatal(err)
+	}
+	return job.Priority
+}
+
+func TestUploadUsesAPIKeyPriority(t *testing.T) {
+	fake, handler := newAPIKeyDB(t, PriorityLow)
+	if rec := uploadWithKey(t, handler, testAPIKey, ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	if got := queuedPriority(t, fake); got != PriorityLow {
+		t.Errorf("priority = %q, want the key's %q", got, PriorityLow)
+	}
+	if lookups := fake.execsLike("SELECT priority FROM api_keys"); len(lookups) != 1 || lookups[0].Args[0] != int64(5) {
+		t.Errorf("priority lookups = %+v, want one for key 5", lookups)
+	}
+}
+
+func TestUploadPriorityOverridesAPIKey(t *testing.T) {
+	fake, handler := newAPIKeyDB(t, PriorityLow)
+	if rec := uploadWithKey(t, handler, testAPIKey, PriorityHigh); rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	if got := queuedPriority(t, fake); got != PriorityHigh {
+		t.Errorf("priority = %q, want the upload's %q", got, PriorityHigh)
+	}
+}
+
+func TestUploadRejectsWrongAPIKey(t *testing.T) {
+	fake, handler := newAPIKeyDB(t, PriorityLow)
+	if rec := uploadWithKey(t, handler, apiKeyPrefix+"other-key", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if jobs := fake.execsLike("INSERT INTO job_outbox"); len(jobs) != 0 {
+		t.Errorf("%d jobs queued for a rejected key", len(jobs))
+	}
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	maxBatchItems     = 1000
+	maxBatchFieldSize = 64 << 10
+)
+
+// BatchItemResult reports the outcome for one file or manifest entry.
+type BatchItemResult struct {
+	Index    int    `json:"index"`
+	Filename string `json:"filename"`
+	VideoID  int    `json:"video_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Accepted int               `json:"accepted"`
+	Failed   int               `json:"failed"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// BatchManifestItem describes a source the worker should fetch itself, such as
+// a presigned URL or a file hosted by the customer.
+type BatchManifestItem struct {
+	UploadMetadata
+	SourceURL string `json:"source_url"`
+	Filename  string `json:"filename"`
+}
+
+type BatchManifest struct {
+	Items []BatchManifestItem `json:"items"`
+}
+
+// BatchUploadHandler creates one video per file in a multipart request, or per
+// entry in a JSON manifest. Each item succeeds or fails on its own. Batch jobs
+// that get no priority from the request or the API key default to low
+// priority so they do not hold up interactive uploads.
+func BatchUploadHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Could not get user ID from token", http.StatusInternalServerError)
+			return
+		}
+		apiKeyID, _ := r.Context().Value(APIKeyIDKey).(int)
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		var resp BatchResponse
+		var err error
+		switch mediaType {
+		case "multipart/form-data":
+			resp, err = batchFromMultipart(db, int(userID), apiKeyID, r)
+		case "application/json":
+			resp, err = batchFromManifest(db, int(userID), apiKeyID, r)
+		default:
+			http.Error(w, "Content-Type must be multipart/form-data or application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		status := http.StatusAccepted
+		if resp.Failed > 0 {
+			status = http.StatusMultiStatus
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// batchFromMultipart streams the request part by part so large batches are
+// never buffered in memory. Metadata fields apply to every file that follows
+// them; title and external_id are per-video and are therefore ignored.
+func batchFromMultipart(db *sql.DB, userID, apiKeyID int, r *http.Request) (BatchResponse, error) {
+	resp := BatchResponse{Results: []BatchItemResult{}}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return resp, errors.New("invalid multipart form")
+	}
+
+	// stop ends the batch at a part that cannot be read or is over the limit.
+	// Videos from earlier parts already exist, so once there are any the
+	// part is reported as a failed item alongside them instead of failing the
+	// whole request.
+	stop := func(filename string, err error) (BatchResponse, error) {
+		if len(resp.Results) == 0 {
+			return resp, err
+		}
+		resp.add(BatchItemResult{Index: len(resp.Results), Filename: filename}, 0, err)
+		return resp, nil
+	}
+
+	values := make(map[string][]string)
+	seen := make(map[string]bool)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stop("", errors.New("invalid multipart form"))
+		}
+
+		if part.FormName() != "file" {
+			data, err := io.ReadAll(io.LimitReader(part, maxBatchFieldSize))
+			part.Close()
+			if err != nil {
+				return stop("", errors.New("invalid multipart form"))
+			}
+			values[part.FormName()] = append(values[part.FormName()], string(data))
+			continue
+		}
+
+		if len(resp.Results) >= maxBatchItems {
+			part.Close()
+			return stop(filepath.Base(part.FileName()), fmt.Errorf("a batch may contain at most %d files", maxBatchItems))
+		}
+		result := BatchItemResult{Index: len(resp.Results), Filename: filepath.Base(part.FileName())}
+		videoID, err := saveBatchFile(db, userID, apiKeyID, part, result.Filename, values, seen)
+		part.Close()
+		resp.add(result, videoID, err)
+	}
+
+	if len(resp.Results) == 0 {
+		return resp, errors.New("no file parts in request")
+	}
+	return resp, nil
+}
+
+func saveBatchFile(db *sql.DB, userID, apiKeyID int, src io.Reader, filename string, values map[string][]string, seen map[string]bool) (int, error) {
+	if filename == "" || filename == "." || filename == string(filepath.Separator) {
+		return 0, errors.New("file part has no filename")
+	}
+	if seen[filename] {
+		return 0, errors.New("duplicate filename in batch")
+	}
+	seen[filename] = true
+
+	shared := make(map[string][]string, len(values))
+	for k, v := range values {
+		if k != "title" && k != "external_id" {
+			shared[k] = v
+		}
+	}
+	meta, err := ParseUploadMetadata(shared, filename)
+	if err != nil {
+		return 0, err
+	}
+	// A JSON metadata part may still carry a title or external_id.
+	meta.Title = strings.TrimSuffix(filename, filepath.Ext(filename))
+	meta.ExternalID = ""
+
+	dst, err := os.CreateTemp(UploadDir, ".upload-*")
+	if err != nil {
+		return 0, errors.New("error creating the file")
+	}
+	uploadPath := dst.Name()
+	_, err = io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		os.Remove(uploadPath)
+		return 0, errors.New("error saving the file")
+	}
+
+	videoID, err := createVideoWithJob(db, userID, apiKeyID, filename, uploadPath, "", PriorityLow, meta)
+	if err != nil {
+		os.Remove(uploadPath)
+		return 0, videoInsertError(err)
+	}
+	return videoID, nil
+}
+
+func batchFromManifest(db *sql.DB, userID, apiKeyID int, r *http.Request) (BatchResponse, error) {
+	resp := BatchResponse{Results: []BatchItemResult{}}
+	var manifest BatchManifest
+	if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		return resp, errors.New("invalid JSON manifest")
+	}
+	if len(manifest.Items) == 0 {
+		return resp, errors.New("manifest has no items")
+	}
+	if len(manifest.Items) > maxBatchItems {
+		return resp, fmt.Errorf("a batch may contain at most %d items", maxBatchItems)
+	}
+
+	for i, item := range manifest.Items {
+		result := BatchItemResult{Index: i, Filename: item.Filename}
+		videoID, err := importManifestItem(db, userID, apiKeyID, &item)
+		result.Filename = item.Filename
+		resp.add(result, videoID, err)
+	}
+	return resp, nil
+}
+
+func importManifestItem(db *sql.DB, userID, apiKeyID int, item *BatchManifestItem) (int, error) {
+	u, err := url.Parse(item.SourceURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, errors.New("source_url must be an absolute http or https URL")
+	}
+	if item.Filename == "" {
+		item.Filename = path.Base(u.Path)
+	}
+	item.Filename = filepath.Base(item.Filename)
+	if item.Filename == "" || item.Filename == "." || item.Filename == "/" {
+		return 0, errors.New("filename is required when source_url has no file name")
+	}
+
+	meta := item.UploadMetadata
+	if err := meta.normalize(item.Filename); err != nil {
+		return 0, err
+	}
+
+	videoID, err := createVideoWithJob(db, userID, apiKeyID, item.Filename, "", item.SourceURL, PriorityLow, meta)
+	if err != nil {
+		return 0, videoInsertError(err)
+	}
+	return videoID, nil
+}
+
+func (b *BatchResponse) add(result BatchItemResult, videoID int, err error) {
+	if err != nil {
+		result.Error = err.Error()
+		b.Failed++
+	} else {
+		result.VideoID = videoID
+		b.Accepted++
+	}
+	b.Results = append(b.Results, result)
+}
+
+func videoInsertError(err error) error {
+	if errors.Is(err, ErrNoWatermark) {
+		return errors.New("watermark requested but no watermark has been uploaded")
+	}
+	if isUniqueViolation(err) {
+		return errors.New("a video with this external_id already exists")
+	}
+	log.Printf("DB insert error: %v", err)
+	return errors.New("failed to create video record")
+}
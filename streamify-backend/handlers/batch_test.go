@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withUploadDir points UploadDir at a temporary directory for one test.
+func withUploadDir(t *testing.T) {
+	t.Helper()
+	dir := UploadDir
+	UploadDir = t.TempDir()
+	t.Cleanup(func() { UploadDir = dir })
+}
+
+// withUser authenticates r as user 1.
+func withUser(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), UserIDKey, float64(1)))
+}
+
+func TestBatchUploadOverLimitKeepsResults(t *testing.T) {
+	withUploadDir(t)
+	db, fake := newFakeDB(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i := 0; i <= maxBatchItems; i++ {
+		part, err := mw.CreateFormFile("file", fmt.Sprintf("clip-%d.mp4", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("video"))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload/batch", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	BatchUploadHandler(db).ServeHTTP(rec, withUser(req))
+
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusMultiStatus, rec.Body)
+	}
+	var resp BatchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Accepted != maxBatchItems || resp.Failed != 1 || len(resp.Results) != maxBatchItems+1 {
+		t.Fatalf("accepted %d, failed %d, %d results; want %d, 1, %d",
+			resp.Accepted, resp.Failed, len(resp.Results), maxBatchItems, maxBatchItems+1)
+	}
+	for i, result := range resp.Results[:maxBatchItems] {
+		if result.VideoID == 0 || result.Error != "" || result.Filename != fmt.Sprintf("clip-%d.mp4", i) {
+			t.Fatalf("result %d = %+v, want the created video", i, result)
+		}
+	}
+	if last := resp.Results[maxBatchItems]; last.Error == "" || last.VideoID != 0 {
+		t.Errorf("overflow result = %+v, want an error and no video", last)
+	}
+	if n := len(fake.execsLike("INSERT INTO job_outbox")); n != maxBatchItems {
+		t.Errorf("%d jobs queued, want %d", n, maxBatchItems)
+	}
+}
+
+func TestBatchUploadBrokenPartKeepsResults(t *testing.T) {
+	withUploadDir(t)
+	db, _ := newFakeDB(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "first.mp4")
+	part.Write([]byte("video"))
+	// A second part with a malformed header.
+	fmt.Fprintf(&body, "\r\n--%s\r\nnot a header\r\n\r\nvideo", mw.Boundary())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload/batch", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	BatchUploadHandler(db).ServeHTTP(rec, withUser(req))
+
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusMultiStatus, rec.Body)
+	}
+	var resp BatchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].VideoID == 0 || resp.Results[1].Error == "" {
+		t.Errorf("results = %+v, want the first video and an error for the broken part", resp.Results)
+	}
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"streamify-backend/outbox"
+)
+
+const (
+	maxCaptionBytes     = 5 << 20
+	maxCaptionLabel     = 100
+	captionsJobTask     = "captions"
+	captionSourceUpload = "upload"
+)
+
+var (
+	languagePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	// srtTiming matches an SRT cue timing line, e.g. "00:00:01,000 --> 00:00:04,500".
+	srtTiming = regexp.MustCompile(`^(\d{1,2}:\d{2}:\d{2})[,.](\d{3})\s*-->\s*(\d{1,2}:\d{2}:\d{2})[,.](\d{3})`)
+)
+
+type CaptionResponse struct {
+	ID       int    `json:"id"`
+	VideoID  int    `json:"video_id"`
+	Language string `json:"language"`
+	Label    string `json:"label"`
+}
+
+// UploadCaptionHandler handles POST /videos/{id}/captions. The multipart form
+// carries the SRT or WebVTT file plus a language tag and an optional label.
+// The track is stored as WebVTT, replacing any earlier track with the same
+// language and label, and the worker is asked to publish it with the video.
+func UploadCaptionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Invalid user ID in token", http.StatusInternalServerError)
+			return
+		}
+
+		idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/videos/"), "/captions")
+		videoID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid video ID in URL path", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxCaptionBytes+1<<20)
+		if err := r.ParseMultipartForm(maxCaptionBytes); err != nil {
+			http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		language := strings.TrimSpace(r.FormValue("language"))
+		if !languagePattern.MatchString(language) {
+			http.Error(w, "language must be a language tag such as en or pt-BR", http.StatusBadRequest)
+			return
+		}
+		label := strings.TrimSpace(r.FormValue("label"))
+		if label == "" {
+			label = language
+		}
+		if len(label) > maxCaptionLabel {
+			http.Error(w, "label is too long", http.StatusBadRequest)
+			return
+		}
+
+		raw, err := io.ReadAll(io.LimitReader(file, maxCaptionBytes+1))
+		if err != nil {
+			http.Error(w, "Error reading the file", http.StatusBadRequest)
+			return
+		}
+		if len(raw) > maxCaptionBytes {
+			http.Error(w, "Caption file is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		vtt, err := ToWebVTT(string(raw))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var owner int
+		err = db.QueryRow("SELECT user_id FROM videos WHERE id = $1", videoID).Scan(&owner)
+		if err == sql.ErrNoRows || (err == nil && owner != int(userID)) {
+			http.Error(w, "Video not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error looking up video for captions: %v", err)
+			http.Error(w, "Failed to save captions", http.StatusInternalServerError)
+			return
+		}
+
+		captionID, err := saveCaption(db, videoID, owner, language, label, vtt)
+		if err != nil {
+			log.Printf("Error saving captions: %v", err)
+			http.Error(w, "Failed to save captions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CaptionResponse{ID: captionID, VideoID: videoID, Language: language, Label: label})
+	}
+}
+
+// saveCaption stores the track and enqueues the worker job that publishes it
+// in one transaction. Publishing is quick and the owner is waiting, so the
+// job runs at high priority.
+func saveCaption(db *sql.DB, videoID, userID int, language, label, vtt string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var captionID int
+	err = tx.QueryRow(`
+	INSERT INTO video_captions (video_id, language, label, source, vtt) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (video_id, language, label) DO UPDATE SET vtt = EXCLUDED.vtt, source = EXCLUDED.source, created_at = NOW()
+	RETURNING id`, videoID, language, label, captionSourceUpload, vtt).Scan(&captionID)
+	if err != nil {
+		return 0, err
+	}
+	if err := outbox.Enqueue(tx, VideoJobQueue, VideoJob{VideoID: videoID, Task: captionsJobTask, UserID: userID, Priority: PriorityHigh}); err != nil {
+		return 0, err
+	}
+	return captionID, tx.Commit()
+}
+
+// ToWebVTT returns the caption file as WebVTT. WebVTT input is passed through
+// with normalized line endings; SRT input has its cue numbers dropped and its
+// timestamps rewritten to use a decimal point.
+func ToWebVTT(input string) (string, error) {
+	input = strings.TrimPrefix(input, "\ufeff")
+	input = strings.ReplaceAll(input, "\r\n", "\n")
+	input = strings.ReplaceAll(input, "\r", "\n")
+
+	if strings.HasPrefix(input, "WEBVTT") {
+		if !strings.Contains(input, "-->") {
+			return "", errors.New("caption file contains no cues")
+		}
+		return input, nil
+	}
+
+	var out strings.Builder
+	out.WriteString("WEBVTT\n")
+	cues := 0
+	for _, block := range strings.Split(input, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		// Lines before the timing line, normally just the cue number, are dropped.
+		for i, line := range lines {
+			m := srtTiming.FindStringSubmatch(strings.TrimSpace(line))
+			if m == nil {
+				continue
+			}
+			cues++
+			out.WriteString("\n" + vttTime(m[1], m[2]) + " --> " + vttTime(m[3], m[4]) + "\n")
+			for _, text := range lines[i+1:] {
+				out.WriteString(text + "\n")
+			}
+			break
+		}
+	}
+	if cues == 0 {
+		return "", errors.New("caption file is neither WebVTT nor SRT")
+	}
+	return out.String(), nil
+}
+
+// vttTime formats an SRT hh:mm:ss and milliseconds pair; WebVTT needs at
+// least two hour digits.
+func vttTime(hms, millis string) string {
+	if len(hms) == 7 {
+		hms = "0" + hms
+	}
+	return hms + "." + millis
+}
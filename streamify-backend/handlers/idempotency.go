@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	IdempotencyHeader = "Idempotency-Key"
+
+	// IdempotencyTTL is how long a stored response can be replayed.
+	IdempotencyTTL = 24 * time.Hour
+
+	idempotencyPendingTTL = 2 * time.Hour
+	maxIdempotencyKeyLen  = 255
+)
+
+// idempotencyRecord is what is stored in Redis for each key. While the first
+// request is still running only Fingerprint is set and Pending is true.
+// Secret marks a completed request whose response was not stored.
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Pending     bool   `json:"pending"`
+	Secret      bool   `json:"secret,omitempty"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// IdempotencyMiddleware makes next safe to retry when the client sends an
+// Idempotency-Key header. The first request's response is stored and replayed
+// for retries with the same key; reusing a key with a different request body
+// is rejected with 422. Requests without the header pass straight through.
+// It must run inside JWTMiddleware so keys are scoped per user.
+func IdempotencyMiddleware(next http.HandlerFunc, rdb *redis.Client) http.HandlerFunc {
+	return idempotencyMiddleware(next, rdb, false)
+}
+
+// SecretIdempotencyMiddleware is IdempotencyMiddleware for endpoints whose
+// response carries a secret, such as a new API key. Only the fact that the
+// request succeeded is stored, and a retry gets 409 instead of the secret.
+func SecretIdempotencyMiddleware(next http.HandlerFunc, rdb *redis.Client) http.HandlerFunc {
+	return idempotencyMiddleware(next, rdb, true)
+}
+
+func idempotencyMiddleware(next http.HandlerFunc, rdb *redis.Client, secret bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLen), http.StatusBadRequest)
+			return
+		}
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Invalid user ID in token", http.StatusInternalServerError)
+			return
+		}
+
+		// Spool the body to disk while hashing it, since uploads can be large.
+		spool, err := os.CreateTemp("", "idempotency-*")
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		if _, err := io.Copy(spool, r.Body); err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		fingerprint, err := requestFingerprint(r, spool)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		r.Body = spool
+
+		ctx := context.Background()
+		redisKey := fmt.Sprintf("idempotency:%d:%s", int(userID), key)
+		pending, _ := json.Marshal(idempotencyRecord{Fingerprint: fingerprint, Pending: true})
+		acquired, err := rdb.SetNX(ctx, redisKey, pending, idempotencyPendingTTL).Result()
+		if err != nil {
+			log.Printf("Idempotency store error: %v", err)
+			http.Error(w, "Failed to check idempotency key", http.StatusInternalServerError)
+			return
+		}
+
+		if !acquired {
+			replayIdempotent(w, rdb, redisKey, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		// Server errors are not stored so the client can retry them.
+		if rec.status >= 500 {
+			rdb.Del(ctx, redisKey)
+			return
+		}
+		record := idempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		}
+		if secret && rec.status < 300 {
+			record = idempotencyRecord{Fingerprint: fingerprint, Secret: true, Status: rec.status}
+		}
+		stored, _ := json.Marshal(record)
+		if err := rdb.Set(ctx, redisKey, stored, IdempotencyTTL).Err(); err != nil {
+			log.Printf("Failed to store idempotent response: %v", err)
+		}
+	}
+}
+
+// requestFingerprint hashes the method, path, content type and body of r,
+// whose body has been spooled to body. Clients pick a new random boundary for
+// every multipart request, so a multipart body is hashed part by part
+// instead: each part's field name, file name and content, in order.
+func requestFingerprint(r *http.Request, body io.ReadSeeker) (string, error) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s\n%s\n", r.Method, r.URL.Path, mediaType)
+		err := hashParts(hash, multipart.NewReader(body, params["boundary"]))
+		if err == nil {
+			return hex.EncodeToString(hash.Sum(nil)), nil
+		}
+		// The handler rejects a malformed body, so hashing its bytes is enough.
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n%s\n", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashParts(hash io.Writer, reader *multipart.Reader) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content := sha256.New()
+		_, err = io.Copy(content, part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%q %q %x\n", part.FormName(), part.FileName(), content.Sum(nil))
+	}
+}
+
+func replayIdempotent(w http.ResponseWriter, rdb *redis.Client, redisKey, fingerprint string) {
+	data, err := rdb.Get(context.Background(), redisKey).Bytes()
+	if err == redis.Nil {
+		// The original request failed and released the key in the meantime.
+		http.Error(w, "A request with this Idempotency-Key just failed; please retry", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Idempotency store error: %v", err)
+		http.Error(w, "Failed to check idempotency key", http.StatusInternalServerError)
+		return
+	}
+
+	var rec idempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		http.Error(w, "Failed to check idempotency key", http.StatusInternalServerError)
+		return
+	}
+	if rec.Fingerprint != fingerprint {
+		http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if rec.Pending {
+		http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+	if rec.Secret {
+		http.Error(w, "A request with this Idempotency-Key already succeeded; its response is not stored", http.StatusConflict)
+		return
+	}
+
+	if rec.ContentType != "" {
+		w.Header().Set("Content-Type", rec.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// multipartUpload encodes a title field and one file with the given boundary.
+func multipartUpload(t *testing.T, boundary, content string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.SetBoundary(boundary); err != nil {
+		t.Fatal(err)
+	}
+	mw.WriteField("title", "Holiday")
+	part, err := mw.CreateFormFile("file", "holiday.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+func TestIdempotencyMultipartRetry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	calls := 0
+	handler := IdempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("handler could not read the replayed body: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"video_id": %d}`, calls)
+	}, rdb)
+
+	send := func(boundary, content string) *httptest.ResponseRecorder {
+		body, contentType := multipartUpload(t, boundary, content)
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(IdempotencyHeader, "upload-1")
+		rec := httptest.NewRecorder()
+		handler(rec, withUser(req))
+		return rec
+	}
+
+	first := send("first-attempt-boundary", "video bytes")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first status = %d, want %d", first.Code, http.StatusCreated)
+	}
+
+	retry := send("second-attempt-boundary", "video bytes")
+	if retry.Code != http.StatusCreated || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry status = %d, replayed = %q; want the stored response", retry.Code, retry.Header().Get("Idempotent-Replayed"))
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("retry body = %s, want %s", retry.Body, first.Body)
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want once", calls)
+	}
+
+	if other := send("third-attempt-boundary", "other video"); other.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status for a different file = %d, want %d", other.Code, http.StatusUnprocessableEntity)
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MediaMetadata is the normalized technical description of a source file.
+type MediaMetadata struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	FrameRate       float64 `json:"frame_rate"`
+	VideoCodec      string  `json:"video_codec"`
+	AudioCodec      string  `json:"audio_codec,omitempty"`
+	AudioChannels   int     `json:"audio_channels,omitempty"`
+	BitRate         int64   `json:"bit_rate"`
+	SizeBytes       int64   `json:"size_bytes"`
+	Container       string  `json:"container"`
+	// AudioTracks lists every audio stream of the source in order.
+	AudioTracks []AudioTrack `json:"audio_tracks,omitempty"`
+}
+
+// AudioTrack describes one audio stream as probed by the worker.
+type AudioTrack struct {
+	Language      string `json:"language,omitempty"`
+	Title         string `json:"title,omitempty"`
+	Codec         string `json:"codec"`
+	Channels      int    `json:"channels"`
+	ChannelLayout string `json:"channel_layout,omitempty"`
+	Default       bool   `json:"default"`
+}
+
+// mediaMetadataColumns selects video_metadata (aliased m) in the order
+// nullableMediaMetadata scans them.
+const mediaMetadataColumns = `m.duration_seconds, m.width, m.height, m.frame_rate, m.video_codec,
+		       m.audio_codec, m.audio_channels, m.bit_rate, m.size_bytes, m.container, m.audio_tracks`
+
+// nullableMediaMetadata scans a LEFT JOINed video_metadata row.
+type nullableMediaMetadata struct {
+	DurationSeconds sql.NullFloat64
+	Width           sql.NullInt64
+	Height          sql.NullInt64
+	FrameRate       sql.NullFloat64
+	VideoCodec      sql.NullString
+	AudioCodec      sql.NullString
+	AudioChannels   sql.NullInt64
+	BitRate         sql.NullInt64
+	SizeBytes       sql.NullInt64
+	Container       sql.NullString
+	AudioTracks     []byte
+}
+
+func (n nullableMediaMetadata) value() *MediaMetadata {
+	if !n.Width.Valid {
+		return nil
+	}
+	var tracks []AudioTrack
+	if len(n.AudioTracks) > 0 {
+		json.Unmarshal(n.AudioTracks, &tracks)
+	}
+	return &MediaMetadata{
+		DurationSeconds: n.DurationSeconds.Float64,
+		Width:           int(n.Width.Int64),
+		Height:          int(n.Height.Int64),
+		FrameRate:       n.FrameRate.Float64,
+		VideoCodec:      n.VideoCodec.String,
+		AudioCodec:      n.AudioCodec.String,
+		AudioChannels:   int(n.AudioChannels.Int64),
+		BitRate:         n.BitRate.Int64,
+		SizeBytes:       n.SizeBytes.Int64,
+		Container:       n.Container.String,
+		AudioTracks:     tracks,
+	}
+}
+
+type MediaMetadataResponse struct {
+	MediaMetadata
+	Probe json.RawMessage `json:"probe"`
+}
+
+// GetVideoMetadataHandler returns a video's metadata including the raw
+// ffprobe output, for GET /videos/{id}/metadata.
+func GetVideoMetadataHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Invalid user ID in token", http.StatusInternalServerError)
+			return
+		}
+
+		idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/videos/"), "/metadata")
+		videoID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid video ID in URL path", http.StatusBadRequest)
+			return
+		}
+
+		var meta nullableMediaMetadata
+		var probe []byte
+		err = db.QueryRow(`
+		SELECT `+mediaMetadataColumns+`, m.probe
+		FROM video_metadata m JOIN videos v ON v.id = m.video_id
+		WHERE m.video_id = $1 AND v.user_id = $2`, videoID, int(userID)).Scan(
+			&meta.DurationSeconds, &meta.Width, &meta.Height, &meta.FrameRate, &meta.VideoCodec,
+			&meta.AudioCodec, &meta.AudioChannels, &meta.BitRate, &meta.SizeBytes, &meta.Container, &meta.AudioTracks, &probe)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Metadata not available for this video", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching video metadata: %v", err)
+			http.Error(w, "Error fetching video metadata", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MediaMetadataResponse{MediaMetadata: *meta.value(), Probe: probe})
+	}
+}
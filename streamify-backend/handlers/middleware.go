@@ -9,7 +9,8 @@ func CORSMiddleware(next http.Handler) http.Handler {
 		// Set the necessary CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, DELETE, PUT")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "Idempotent-Replayed")
 
 		// If it's a preflight (OPTIONS) request, we handle it and stop the chain here.
 		// The browser is just asking for permission.
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type NotificationResponse struct {
+	ID        int        `json:"id"`
+	VideoID   *int       `json:"video_id,omitempty"`
+	Kind      string     `json:"kind"`
+	Message   string     `json:"message"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// GetNotificationsHandler lists the user's most recent notifications, such as
+// uploads rejected by the malware scanner.
+func GetNotificationsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Invalid user ID in token", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`
+		SELECT id, video_id, kind, message, created_at, read_at
+		FROM notifications WHERE user_id = $1 ORDER BY created_at DESC LIMIT 100`, int(userID))
+		if err != nil {
+			log.Printf("Error querying notifications: %v", err)
+			http.Error(w, "Error fetching notifications", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		notifications := []NotificationResponse{}
+		for rows.Next() {
+			var n NotificationResponse
+			var videoID sql.NullInt64
+			var readAt sql.NullTime
+			if err := rows.Scan(&n.ID, &videoID, &n.Kind, &n.Message, &n.CreatedAt, &readAt); err != nil {
+				log.Printf("Error scanning notification row: %v", err)
+				continue
+			}
+			if videoID.Valid {
+				id := int(videoID.Int64)
+				n.VideoID = &id
+			}
+			if readAt.Valid {
+				n.ReadAt = &readAt.Time
+			}
+			notifications = append(notifications, n)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notifications)
+	}
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import "database/sql"
+
+// userOrg returns the organization the user belongs to. A user who is not in
+// one yet gets a personal organization named after them.
+func userOrg(db *sql.DB, userID int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var orgID sql.NullInt64
+	var username string
+	err = tx.QueryRow("SELECT org_id, username FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&orgID, &username)
+	if err != nil {
+		return 0, err
+	}
+	if orgID.Valid {
+		return int(orgID.Int64), nil
+	}
+
+	var id int
+	if err := tx.QueryRow("INSERT INTO organizations (name) VALUES ($1) RETURNING id", username).Scan(&id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE users SET org_id = $1 WHERE id = $2", id, userID); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
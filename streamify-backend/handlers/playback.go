@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"streamify-backend/storage"
+)
+
+// PlaybackTokenTTL bounds how long a player can fetch a video's content key.
+const PlaybackTokenTTL = time.Hour
+
+const playbackTokenType = "playback"
+
+// maxPlaylistBytes bounds a stored playlist read by PlaybackPlaylistHandler.
+const maxPlaylistBytes = 1 << 20
+
+// PlaybackTokenResponse carries the token and URLs with it attached, both
+// relative to the API. Players that cannot add the token to key requests,
+// such as Safari's native player, play PlaylistURL; players that can
+// override the key URI may use KeyURI with the stored playlists instead.
+type PlaybackTokenResponse struct {
+	Token       string    `json:"token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	PlaylistURL string    `json:"playlist_url,omitempty"`
+	KeyURI      string    `json:"key_uri,omitempty"`
+}
+
+// ParseContentKeyMaster decodes the base64 CONTENT_KEY_MASTER setting, the
+// AES-256 key the worker uses to encrypt content keys at rest.
+func ParseContentKeyMaster(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("content key master is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("content key master must be 32 bytes")
+	}
+	return key, nil
+}
+
+// PlaybackTokenHandler issues a short-lived token for
+// POST /videos/{id}/playback-token. Owners can play any of their videos;
+// other users only public and unlisted ones.
+func PlaybackTokenHandler(db *sql.DB, jwtSecret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Invalid user ID in token", http.StatusInternalServerError)
+			return
+		}
+
+		idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/videos/"), "/playback-token")
+		videoID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid video ID in URL path", http.StatusBadRequest)
+			return
+		}
+
+		var ownerID int
+		var visibility string
+		var masterKey sql.NullString
+		var encrypted bool
+		query := `
+		SELECT v.user_id, v.visibility, v.s3_key, EXISTS (SELECT 1 FROM video_keys k WHERE k.video_id = v.id)
+		FROM videos v WHERE v.id = $1`
+		err = db.QueryRow(query, videoID).Scan(&ownerID, &visibility, &masterKey, &encrypted)
+		if err == sql.ErrNoRows || (err == nil && ownerID != int(userID) && visibility == "private") {
+			http.Error(w, "Video not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error looking up video for playback token: %v", err)
+			http.Error(w, "Error creating playback token", http.StatusInternalServerError)
+			return
+		}
+
+		// No user_id claim, so the token cannot be used against JWTMiddleware.
+		expiresAt := time.Now().Add(PlaybackTokenTTL)
+		claims := jwt.MapClaims{
+			"typ":      playbackTokenType,
+			"video_id": videoID,
+			"exp":      expiresAt.Unix(),
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		if err != nil {
+			http.Error(w, "Error creating playback token", http.StatusInternalServerError)
+			return
+		}
+
+		resp := PlaybackTokenResponse{Token: token, ExpiresAt: expiresAt.UTC()}
+		if masterKey.Valid {
+			resp.PlaylistURL = playbackPlaylistURL(videoID, path.Base(masterKey.String), token)
+		}
+		if encrypted {
+			resp.KeyURI = fmt.Sprintf("/content-keys/%d?token=%s", videoID, url.QueryEscape(token))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// PlaybackPlaylistHandler serves GET /playback/{id}/{playlist} to holders of
+// a playback token, passed as the token query parameter. The stored playlist
+// is rewritten so nested playlists come back through this handler with the
+// token, segments point at their media URLs and #EXT-X-KEY URIs carry the
+// token, which players fetching keys themselves cannot otherwise send.
+func PlaybackPlaylistHandler(db *sql.DB, store storage.Storage, jwtSecret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		idStr, rel, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/playback/"), "/")
+		videoID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid video ID in URL path", http.StatusBadRequest)
+			return
+		}
+		rel = path.Clean(rel)
+		if path.Ext(rel) != ".m3u8" || rel == ".." || strings.HasPrefix(rel, "../") || strings.HasPrefix(rel, "/") {
+			http.Error(w, "Playlist not found", http.StatusNotFound)
+			return
+		}
+
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "Missing playback token", http.StatusUnauthorized)
+			return
+		}
+		if !validPlaybackToken(token, jwtSecret, videoID) {
+			http.Error(w, "Invalid playback token", http.StatusForbidden)
+			return
+		}
+
+		var masterKey sql.NullString
+		err = db.QueryRow("SELECT s3_key FROM videos WHERE id = $1 AND status = 'ready'", videoID).Scan(&masterKey)
+		if err == sql.ErrNoRows || (err == nil && !masterKey.Valid) {
+			http.Error(w, "Video not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error looking up video for playback: %v", err)
+			http.Error(w, "Error fetching playlist", http.StatusInternalServerError)
+			return
+		}
+		prefix := path.Dir(masterKey.String)
+		obj, err := store.Get(r.Context(), prefix+"/"+rel)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Playlist not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching playlist %s/%s: %v", prefix, rel, err)
+			http.Error(w, "Error fetching playlist", http.StatusInternalServerError)
+			return
+		}
+		defer obj.Close()
+		playlist, err := io.ReadAll(io.LimitReader(obj, maxPlaylistBytes))
+		if err != nil {
+			log.Printf("Error reading playlist %s/%s: %v", prefix, rel, err)
+			http.Error(w, "Error fetching playlist", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		// The body holds the token.
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, rewritePlaylist(string(playlist), videoID, prefix, path.Dir(rel), token))
+	}
+}
+
+func playbackPlaylistURL(videoID int, rel, token string) string {
+	return fmt.Sprintf("/playback/%d/%s?token=%s", videoID, rel, url.QueryEscape(token))
+}
+
+var uriAttrPattern = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewritePlaylist points the URIs of a stored playlist, which lives in dir
+// under the video's storage prefix, at URLs a player can fetch: playlists
+// through PlaybackPlaylistHandler, other files at their media URLs and keys
+// with the token attached.
+func rewritePlaylist(playlist string, videoID int, prefix, dir, token string) string {
+	resolve := func(uri string) string {
+		if strings.Contains(uri, "://") {
+			return uri
+		}
+		ref := path.Join(dir, uri)
+		if path.Ext(ref) == ".m3u8" {
+			return playbackPlaylistURL(videoID, ref, token)
+		}
+		return MediaURL(prefix + "/" + ref)
+	}
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-KEY:") || strings.HasPrefix(line, "#EXT-X-SESSION-KEY:"):
+			lines[i] = uriAttrPattern.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := uriAttrPattern.FindStringSubmatch(attr)[1]
+				sep := "?"
+				if strings.Contains(uri, "?") {
+					sep = "&"
+				}
+				return `URI="` + uri + sep + "token=" + url.QueryEscape(token) + `"`
+			})
+		case strings.HasPrefix(line, "#"):
+			lines[i] = uriAttrPattern.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + resolve(uriAttrPattern.FindStringSubmatch(attr)[1]) + `"`
+			})
+		case strings.TrimSpace(line) != "":
+			lines[i] = resolve(strings.TrimSpace(line))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ContentKeyHandler serves the AES-128 key of an encrypted video for
+// GET /content-keys/{id}, the URI in the playlists' #EXT-X-KEY tags. The
+// playback token is read from the Authorization header or, for players that
+// cannot set headers, the token query parameter.
+func ContentKeyHandler(db *sql.DB, jwtSecret string, master []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		videoID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/content-keys/"))
+		if err != nil {
+			http.Error(w, "Invalid video ID in URL path", http.StatusBadRequest)
+			return
+		}
+
+		tokenStr := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			tokenStr = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if tokenStr == "" {
+			http.Error(w, "Missing playback token", http.StatusUnauthorized)
+			return
+		}
+		if !validPlaybackToken(tokenStr, jwtSecret, videoID) {
+			http.Error(w, "Invalid playback token", http.StatusForbidden)
+			return
+		}
+		if master == nil {
+			http.Error(w, "Content key not found", http.StatusNotFound)
+			return
+		}
+
+		var sealed []byte
+		err = db.QueryRow("SELECT encrypted_key FROM video_keys WHERE video_id = $1", videoID).Scan(&sealed)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Content key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching content key: %v", err)
+			http.Error(w, "Error fetching content key", http.StatusInternalServerError)
+			return
+		}
+		key, err := openContentKey(master, videoID, sealed)
+		if err != nil {
+			log.Printf("Error decrypting content key for video %d: %v", videoID, err)
+			http.Error(w, "Error fetching content key", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(key)
+	}
+}
+
+func validPlaybackToken(tokenStr, jwtSecret string, videoID int) bool {
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(jwtSecret), nil
+	})
+	if err != nil || !token.Valid {
+		return false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != playbackTokenType {
+		return false
+	}
+	id, ok := claims["video_id"].(float64)
+	return ok && int(id) == videoID
+}
+
+// openContentKey reverses the worker's sealing: AES-256-GCM under the master
+// key with a 12-byte nonce prefix, authenticated with the video ID so a key
+// row cannot be moved to another video.
+func openContentKey(master []byte, videoID int, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed content key is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(videoID)))
+}
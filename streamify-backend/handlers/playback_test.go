@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"streamify-backend/storage"
+)
+
+const testJWTSecret = "jwt-secret"
+
+// newPlaybackStore returns local storage holding an encrypted video 9.
+func newPlaybackStore(t *testing.T) storage.Storage {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"videos/9/clip.mp4/master.m3u8": "#EXTM3U\n" +
+			"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"English\",URI=\"subtitles/en/playlist.m3u8\"\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2928000,RESOLUTION=1280x720\n720p/playlist.m3u8\n",
+		"videos/9/clip.mp4/720p/playlist.m3u8": "#EXTM3U\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"https://api.test/content-keys/9\",IV=0x01\n" +
+			"#EXTINF:6.000000,\nsegment0.ts\n#EXT-X-ENDLIST\n",
+	}
+	for key, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := storage.NewLocal(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func playbackToken(t *testing.T, fake *fakeDB, handler http.HandlerFunc) PlaybackTokenResponse {
+	t.Helper()
+	fake.setRows("SELECT v.user_id, v.visibility, v.s3_key", []driver.Value{int64(1), "private", "videos/9/clip.mp4/master.m3u8", true})
+	req := httptest.NewRequest(http.MethodPost, "/videos/9/playback-token", nil)
+	rec := httptest.NewRecorder()
+	handler(rec, withUser(req))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("token status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp PlaybackTokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestPlaybackPlaylistCarriesToken(t *testing.T) {
+	t.Setenv("MEDIA_BASE_URL", "https://media.test")
+	db, fake := newFakeDB(t)
+	fake.setRows("SELECT s3_key FROM videos", []driver.Value{"videos/9/clip.mp4/master.m3u8"})
+	resp := playbackToken(t, fake, PlaybackTokenHandler(db, testJWTSecret))
+	if want := "/content-keys/9?token=" + resp.Token; resp.KeyURI != want {
+		t.Errorf("key_uri = %q, want %q", resp.KeyURI, want)
+	}
+	if want := "/playback/9/master.m3u8?token=" + resp.Token; resp.PlaylistURL != want {
+		t.Fatalf("playlist_url = %q, want %q", resp.PlaylistURL, want)
+	}
+
+	handler := PlaybackPlaylistHandler(db, newPlaybackStore(t), testJWTSecret)
+	get := func(url string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", url, rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+
+	master := get(resp.PlaylistURL)
+	for _, want := range []string{
+		"\n/playback/9/720p/playlist.m3u8?token=" + resp.Token + "\n",
+		`URI="/playback/9/subtitles/en/playlist.m3u8?token=` + resp.Token + `"`,
+	} {
+		if !strings.Contains(master, want) {
+			t.Errorf("master playlist =\n%s\nwant it to contain %s", master, want)
+		}
+	}
+	media := get("/playback/9/720p/playlist.m3u8?token=" + resp.Token)
+	for _, want := range []string{
+		`URI="https://api.test/content-keys/9?token=` + resp.Token + `"`,
+		"\nhttps://media.test/videos/9/clip.mp4/720p/segment0.ts\n",
+	} {
+		if !strings.Contains(media, want) {
+			t.Errorf("media playlist =\n%s\nwant it to contain %s", media, want)
+		}
+	}
+}
+
+func TestPlaybackPlaylistRejects(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.setRows("SELECT s3_key FROM videos", []driver.Value{"videos/9/clip.mp4/master.m3u8"})
+	token := playbackToken(t, fake, PlaybackTokenHandler(db, testJWTSecret)).Token
+	handler := PlaybackPlaylistHandler(db, newPlaybackStore(t), testJWTSecret)
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{"no token", "/playback/9/master.m3u8", http.StatusUnauthorized},
+		{"other video", "/playback/10/master.m3u8?token=" + token, http.StatusForbidden},
+		{"outside the video", "/playback/9/../../8/clip.mp4/master.m3u8?token=" + token, http.StatusNotFound},
+		{"not a playlist", "/playback/9/720p/segment0.ts?token=" + token, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.Path, req.URL.RawQuery, _ = strings.Cut(tt.url, "?")
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.url, rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"streamify-backend/outbox"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// UploadDir is the uploads volume shared with the worker.
+var UploadDir = "/app/uploads"
+
+const (
+	VideoJobQueue = "video_jobs"
+
+	DefaultEncodingProfile = "standard"
+	DefaultVisibility      = "private"
+	DefaultOutputFormat    = "hls"
+
+	maxTitleLength       = 200
+	maxDescriptionLength = 5000
+	maxTags              = 20
+	maxTagLength         = 50
+	maxExternalIDLength  = 128
+)
+
+// EncodingProfiles lists the profile names the worker knows how to encode.
+// The H.264 profiles differ in quality and speed; hevc, av1 and vp9 encode
+// the ladder in that codec plus H.264 renditions for older players.
+var EncodingProfiles = map[string]bool{
+	"standard":      true,
+	"high_quality":  true,
+	"fast":          true,
+	"fixed_bitrate": true,
+	"hevc":          true,
+	"av1":           true,
+	"vp9":           true,
+}
+
+// OutputFormats lists the packaging formats the worker can produce: plain HLS
+// with MPEG-TS segments, or CMAF segments shared by HLS and DASH.
+var OutputFormats = map[string]bool{
+	"hls":  true,
+	"cmaf": true,
+}
+
+// EncryptedOutput is set when the worker encrypts HLS output. ffmpeg cannot
+// encrypt CMAF segments, so CMAF uploads are then refused rather than
+// published in the clear.
+var EncryptedOutput bool
+
+var visibilities = map[string]bool{
+	"public":   true,
+	"unlisted": true,
+	"private":  true,
+}
+
+var externalIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// UploadMetadata holds the optional fields a client can send alongside the file,
+// either as individual multipart fields or as a single JSON "metadata" part.
+type UploadMetadata struct {
+	Title        string   `json:"title"`
+	Description  string   `json:"description"`
+	Tags         []string `json:"tags"`
+	Visibility   string   `json:"visibility"`
+	ExternalID   string   `json:"external_id"`
+	Profile      string   `json:"profile"`
+	OutputFormat string   `json:"output_format"`
+	// Priority is empty unless the upload asked for one; see jobPriority.
+	Priority string `json:"priority"`
+	// Watermark burns the watermark of the owner's organization and
+	// WatermarkText a text overlay, such as a reviewer's email address, into
+	// preview copies of the renditions named in WatermarkRenditions, or of
+	// every rendition when it is empty. The clean renditions are still
+	// published.
+	Watermark           bool     `json:"watermark"`
+	WatermarkText       string   `json:"watermark_text"`
+	WatermarkRenditions []string `json:"watermark_renditions"`
+}
+
+// Job priorities. The worker schedules high ahead of normal ahead of low,
+// shares capacity fairly between users within each priority, and lets
+// waiting jobs age so low priority work still makes progress.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+var Priorities = map[string]bool{PriorityHigh: true, PriorityNormal: true, PriorityLow: true}
+
+// VideoJob is the payload pushed onto the queue for the worker.
+type VideoJob struct {
+	Filename     string `json:"filename"`
+	VideoID      int    `json:"video_id"`
+	Profile      string `json:"profile"`
+	OutputFormat string `json:"output_format"`
+	// Task is empty for transcoding jobs and "captions" for jobs that only
+	// publish a video's caption tracks.
+	Task string `json:"task,omitempty"`
+	// SourceURL is set for imported videos; the worker downloads it into the
+	// upload directory before processing.
+	SourceURL string `json:"source_url,omitempty"`
+	// UserID and Priority drive the worker's fair scheduling.
+	UserID   int    `json:"user_id"`
+	Priority string `json:"priority"`
+	// Watermark and WatermarkText are the overlays to burn into the preview
+	// copies of WatermarkRenditions.
+	Watermark           bool     `json:"watermark,omitempty"`
+	WatermarkText       string   `json:"watermark_text,omitempty"`
+	WatermarkRenditions []string `json:"watermark_renditions,omitempty"`
+}
+
+func UploadHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Could not get user ID from token", http.StatusInternalServerError)
+			return
+		}
+
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+			return
+		}
+		file, handler, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		meta, err := ParseUploadMetadata(r.MultipartForm.Value, handler.Filename)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dst, err := os.CreateTemp(UploadDir, ".upload-*")
+		if err != nil {
+			http.Error(w, "Error creating the file", http.StatusInternalServerError)
+			return
+		}
+		uploadPath := dst.Name()
+		defer dst.Close()
+
+		if _, err := io.Copy(dst, file); err != nil {
+			os.Remove(uploadPath)
+			http.Error(w, "Error saving the file", http.StatusInternalServerError)
+			return
+		}
+
+		apiKeyID, _ := r.Context().Value(APIKeyIDKey).(int)
+		videoID, err := createVideoWithJob(db, int(userID), apiKeyID, handler.Filename, uploadPath, "", PriorityNormal, meta)
+		if err != nil {
+			os.Remove(uploadPath)
+			if errors.Is(err, ErrNoWatermark) {
+				http.Error(w, "watermark requested but no watermark has been uploaded", http.StatusBadRequest)
+				return
+			}
+			if isUniqueViolation(err) {
+				http.Error(w, "A video with this external_id already exists", http.StatusConflict)
+				return
+			}
+			log.Printf("DB insert error: %v", err)
+			http.Error(w, "Failed to create video record", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":  "File uploaded and processing started.",
+			"video_id": videoID,
+		})
+	}
+}
+
+// ParseUploadMetadata reads the optional metadata fields from a multipart form,
+// applies defaults and validates them. Individual fields override anything sent
+// in the JSON "metadata" part.
+func ParseUploadMetadata(values map[string][]string, filename string) (UploadMetadata, error) {
+	var meta UploadMetadata
+	if raw := firstValue(values, "metadata"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+			return meta, errors.New("metadata must be a valid JSON object")
+		}
+	}
+
+	if v := firstValue(values, "title"); v != "" {
+		meta.Title = v
+	}
+	if v := firstValue(values, "description"); v != "" {
+		meta.Description = v
+	}
+	if v := firstValue(values, "visibility"); v != "" {
+		meta.Visibility = v
+	}
+	if v := firstValue(values, "external_id"); v != "" {
+		meta.ExternalID = v
+	}
+	if v := firstValue(values, "profile"); v != "" {
+		meta.Profile = v
+	}
+	if v := firstValue(values, "output_format"); v != "" {
+		meta.OutputFormat = v
+	}
+	if v := firstValue(values, "priority"); v != "" {
+		meta.Priority = v
+	}
+	if v := firstValue(values, "watermark"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return meta, errors.New("watermark must be true or false")
+		}
+		meta.Watermark = b
+	}
+	if v := firstValue(values, "watermark_text"); v != "" {
+		meta.WatermarkText = v
+	}
+	if names, ok := values["watermark_renditions"]; ok {
+		meta.WatermarkRenditions = nil
+		for _, n := range names {
+			meta.WatermarkRenditions = append(meta.WatermarkRenditions, strings.Split(n, ",")...)
+		}
+	}
+	// Tags may be sent as repeated fields, a comma-separated list, or both.
+	if tags, ok := values["tags"]; ok {
+		meta.Tags = nil
+		for _, t := range tags {
+			meta.Tags = append(meta.Tags, strings.Split(t, ",")...)
+		}
+	}
+
+	return meta, meta.normalize(filename)
+}
+
+func (m *UploadMetadata) normalize(filename string) error {
+	m.Title = strings.TrimSpace(m.Title)
+	if m.Title == "" {
+		m.Title = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	if len([]rune(m.Title)) > maxTitleLength {
+		return fmt.Errorf("title must be at most %d characters", maxTitleLength)
+	}
+
+	m.Description = strings.TrimSpace(m.Description)
+	if len([]rune(m.Description)) > maxDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+	}
+
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, t := range m.Tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if len([]rune(t)) > maxTagLength {
+			return fmt.Errorf("tags must be at most %d characters each", maxTagLength)
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	m.Tags = tags
+
+	m.Visibility = strings.ToLower(strings.TrimSpace(m.Visibility))
+	if m.Visibility == "" {
+		m.Visibility = DefaultVisibility
+	}
+	if !visibilities[m.Visibility] {
+		return errors.New("visibility must be one of public, unlisted or private")
+	}
+
+	m.ExternalID = strings.TrimSpace(m.ExternalID)
+	if m.ExternalID != "" {
+		if len(m.ExternalID) > maxExternalIDLength || !externalIDPattern.MatchString(m.ExternalID) {
+			return fmt.Errorf("external_id must be at most %d characters of letters, digits, '.', '_', ':' or '-'", maxExternalIDLength)
+		}
+	}
+
+	m.Profile = strings.ToLower(strings.TrimSpace(m.Profile))
+	if m.Profile == "" {
+		m.Profile = DefaultEncodingProfile
+	}
+	if !EncodingProfiles[m.Profile] {
+		return fmt.Errorf("unknown encoding profile %q", m.Profile)
+	}
+
+	m.OutputFormat = strings.ToLower(strings.TrimSpace(m.OutputFormat))
+	if m.OutputFormat == "" {
+		m.OutputFormat = DefaultOutputFormat
+	}
+	if !OutputFormats[m.OutputFormat] {
+		return errors.New("output_format must be hls or cmaf")
+	}
+	if m.OutputFormat == "cmaf" && EncryptedOutput {
+		return errors.New("output_format cmaf is not available because output is encrypted")
+	}
+
+	m.Priority = strings.ToLower(strings.TrimSpace(m.Priority))
+	if m.Priority != "" && !Priorities[m.Priority] {
+		return errors.New("priority must be high, normal or low")
+	}
+
+	m.WatermarkText = strings.TrimSpace(m.WatermarkText)
+	if len([]rune(m.WatermarkText)) > maxWatermarkText {
+		return fmt.Errorf("watermark_text must be at most %d characters", maxWatermarkText)
+	}
+	if strings.IndexFunc(m.WatermarkText, unicode.IsControl) >= 0 {
+		return errors.New("watermark_text must be a single line")
+	}
+
+	seen = make(map[string]bool)
+	var renditions []string
+	for _, n := range m.WatermarkRenditions {
+		n = strings.ToLower(strings.TrimSpace(n))
+		if n == "" || seen[n] {
+			continue
+		}
+		if !previewRenditions[n] {
+			return errors.New("watermark_renditions must name renditions among 1080p, 720p, 480p and 360p")
+		}
+		seen[n] = true
+		renditions = append(renditions, n)
+	}
+	m.WatermarkRenditions = renditions
+	if !m.Watermark && m.WatermarkText == "" {
+		if len(m.WatermarkRenditions) > 0 {
+			return errors.New("watermark_renditions needs watermark or watermark_text")
+		}
+	} else if m.OutputFormat == "cmaf" {
+		// The DASH manifest would list the clean and watermarked streams together.
+		return errors.New("output_format cmaf is not available for watermarked uploads")
+	}
+	return nil
+}
+
+// createVideoWithJob inserts the video row and its processing job in a single
+// transaction, so a video never exists without a job to process it.
+// stagedPath, when set, is the uploaded file, which is moved to the video's
+// SourcePath before the job can be seen. apiKeyID is the key the upload was
+// authenticated with, or 0, and defaultPriority applies when neither the
+// upload nor that key sets a priority.
+func createVideoWithJob(db *sql.DB, userID, apiKeyID int, filename, stagedPath, sourceURL, defaultPriority string, meta UploadMetadata) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	videoID, err := insertVideo(tx, userID, filename, meta)
+	if err != nil {
+		return 0, err
+	}
+	priority, err := jobPriority(tx, apiKeyID, meta.Priority, defaultPriority)
+	if err != nil {
+		return 0, err
+	}
+	if meta.Watermark {
+		var exists bool
+		query := "SELECT EXISTS (SELECT 1 FROM watermarks w JOIN users u ON u.org_id = w.org_id WHERE u.id = $1)"
+		if err := tx.QueryRow(query, userID).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, ErrNoWatermark
+		}
+	}
+	job := VideoJob{
+		Filename:            filename,
+		VideoID:             videoID,
+		Profile:             meta.Profile,
+		OutputFormat:        meta.OutputFormat,
+		SourceURL:           sourceURL,
+		UserID:              userID,
+		Priority:            priority,
+		Watermark:           meta.Watermark,
+		WatermarkText:       meta.WatermarkText,
+		WatermarkRenditions: meta.WatermarkRenditions,
+	}
+	if err := outbox.Enqueue(tx, VideoJobQueue, job); err != nil {
+		return 0, err
+	}
+	if stagedPath != "" {
+		if err := os.Rename(stagedPath, SourcePath(videoID, filename)); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		if stagedPath != "" {
+			// Move it back so the caller's cleanup removes it.
+			os.Rename(SourcePath(videoID, filename), stagedPath)
+		}
+		return 0, err
+	}
+	return videoID, nil
+}
+
+// SourcePath is where a video's source file waits on the uploads volume
+// shared with the worker. Filenames come from clients and are not unique, so
+// the path is keyed by video ID.
+func SourcePath(videoID int, filename string) string {
+	return filepath.Join(UploadDir, fmt.Sprintf("%d-%s", videoID, filename))
+}
+
+// jobPriority picks the upload's own priority, else the one configured on
+// the API key it was made with (see SetAPIKeyPriorityHandler), else
+// defaultPriority.
+func jobPriority(tx *sql.Tx, apiKeyID int, requested, defaultPriority string) (string, error) {
+	if requested != "" {
+		return requested, nil
+	}
+	if apiKeyID == 0 {
+		return defaultPriority, nil
+	}
+	var keyPriority sql.NullString
+	err := tx.QueryRow("SELECT priority FROM api_keys WHERE id = $1", apiKeyID).Scan(&keyPriority)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if keyPriority.Valid && keyPriority.String != "" {
+		return keyPriority.String, nil
+	}
+	return defaultPriority, nil
+}
+
+func insertVideo(tx *sql.Tx, userID int, filename string, meta UploadMetadata) (int, error) {
+	var videoID int
+	query := `
+	INSERT INTO videos (user_id, filename, title, description, tags, visibility, external_id, encoding_profile, output_format, status)
+	VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, 'processing') RETURNING id`
+	err := tx.QueryRow(query, userID, filename, meta.Title, meta.Description, pq.Array(meta.Tags),
+		meta.Visibility, meta.ExternalID, meta.Profile, meta.OutputFormat).Scan(&videoID)
+	return videoID, err
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func firstValue(values map[string][]string, key string) string {
+	if v := values[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUploadMetadataWatermarkRenditions(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string][]string
+		want    []string
+		wantErr bool
+	}{
+		{"every rendition", map[string][]string{"watermark_text": {"a@example.com"}}, nil, false},
+		{"listed", map[string][]string{"watermark_text": {"a@example.com"}, "watermark_renditions": {"360p, 480P", "360p"}}, []string{"360p", "480p"}, false},
+		{"unknown rendition", map[string][]string{"watermark_text": {"a@example.com"}, "watermark_renditions": {"4k"}}, nil, true},
+		{"no overlay", map[string][]string{"watermark_renditions": {"360p"}}, nil, true},
+		{"cmaf", map[string][]string{"watermark_text": {"a@example.com"}, "output_format": {"cmaf"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := ParseUploadMetadata(tt.values, "clip.mp4")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseUploadMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(meta.WatermarkRenditions, tt.want) {
+				t.Errorf("WatermarkRenditions = %q, want %q", meta.WatermarkRenditions, tt.want)
+			}
+		})
+	}
+}
@@ -1,19 +1,22 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+
+	"streamify-backend/storage"
 )
 
 type VideoResponse struct {
@@ -24,6 +27,39 @@ type VideoResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Filename  string    `json:"filename"`
 	Title     string    `json:"title"`
+
+	Description  string   `json:"description"`
+	Tags         []string `json:"tags"`
+	Visibility   string   `json:"visibility"`
+	ExternalID   string   `json:"external_id,omitempty"`
+	Profile      string   `json:"profile"`
+	OutputFormat string   `json:"output_format"`
+	// DashKey points at the DASH manifest for CMAF output.
+	DashKey string `json:"dash_key,omitempty"`
+	// PreviewKey points at the watermarked preview playlist, if any.
+	PreviewKey string `json:"preview_key,omitempty"`
+	// Encrypted videos need a playback token to fetch their content key.
+	Encrypted bool `json:"encrypted"`
+	// StatusReason explains a failed or rejected status.
+	StatusReason string `json:"status_reason,omitempty"`
+	// Progress is only set while the video is processing.
+	Progress *VideoProgress `json:"progress,omitempty"`
+
+	PosterURL     string            `json:"poster_url,omitempty"`
+	ThumbnailURLs map[string]string `json:"thumbnail_urls,omitempty"`
+	SpriteURL     string            `json:"sprite_url,omitempty"`
+	StoryboardURL string            `json:"storyboard_url,omitempty"`
+
+	// Metadata is set once the worker has probed the source.
+	Metadata *MediaMetadata `json:"metadata,omitempty"`
+}
+
+// VideoProgress is the worker's latest report for a processing video.
+type VideoProgress struct {
+	Stage      string    `json:"stage"`
+	Percent    float64   `json:"percent"`
+	ETASeconds *int      `json:"eta_seconds,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 func GetUserVideosHandler(db *sql.DB) http.HandlerFunc {
@@ -34,7 +70,33 @@ func GetUserVideosHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query("SELECT id, user_id, status, s3_key, created_at, filename, title FROM videos WHERE user_id = $1 ORDER BY created_at DESC", int(userID))
+		query := `
+		SELECT v.id, v.user_id, v.status, v.s3_key, v.created_at, v.filename, v.title,
+		       v.description, v.tags, v.visibility, v.external_id, v.encoding_profile, v.output_format, v.dash_key, v.preview_key, v.status_reason,
+		       v.progress_stage, v.progress_percent, v.progress_eta_seconds, v.progress_updated_at,
+		       v.poster_key, v.thumbnail_keys, v.sprite_key, v.storyboard_key,
+		       EXISTS (SELECT 1 FROM video_keys k WHERE k.video_id = v.id),
+		       ` + mediaMetadataColumns + `
+		FROM videos v LEFT JOIN video_metadata m ON m.video_id = v.id
+		WHERE v.user_id = $1`
+		args := []interface{}{int(userID)}
+		// Optional resolution filters, e.g. ?min_height=720 for HD sources.
+		for param, cond := range map[string]string{"min_height": "m.height >= $%d", "max_height": "m.height <= $%d"} {
+			v := r.URL.Query().Get(param)
+			if v == "" {
+				continue
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("Invalid %s", param), http.StatusBadRequest)
+				return
+			}
+			args = append(args, n)
+			query += " AND " + fmt.Sprintf(cond, len(args))
+		}
+		query += " ORDER BY v.created_at DESC"
+
+		rows, err := db.Query(query, args...)
 		if err != nil {
 			log.Printf("Error querying videos: %v", err)
 			http.Error(w, "Error fetching videos", http.StatusInternalServerError)
@@ -45,12 +107,47 @@ func GetUserVideosHandler(db *sql.DB) http.HandlerFunc {
 		var videos []VideoResponse
 		for rows.Next() {
 			var video VideoResponse
-			var s3Key sql.NullString
-			if err := rows.Scan(&video.ID, &video.UserID, &video.Status, &s3Key, &video.CreatedAt, &video.Filename, &video.Title); err != nil {
+			var s3Key, externalID, dashKey, previewKey, statusReason, stage sql.NullString
+			var percent sql.NullFloat64
+			var eta sql.NullInt64
+			var progressAt sql.NullTime
+			var posterKey, spriteKey, storyboardKey sql.NullString
+			var thumbnailKeys []byte
+			var meta nullableMediaMetadata
+			if err := rows.Scan(&video.ID, &video.UserID, &video.Status, &s3Key, &video.CreatedAt, &video.Filename, &video.Title,
+				&video.Description, pq.Array(&video.Tags), &video.Visibility, &externalID, &video.Profile, &video.OutputFormat, &dashKey, &previewKey, &statusReason,
+				&stage, &percent, &eta, &progressAt,
+				&posterKey, &thumbnailKeys, &spriteKey, &storyboardKey, &video.Encrypted,
+				&meta.DurationSeconds, &meta.Width, &meta.Height, &meta.FrameRate, &meta.VideoCodec,
+				&meta.AudioCodec, &meta.AudioChannels, &meta.BitRate, &meta.SizeBytes, &meta.Container, &meta.AudioTracks); err != nil {
 				log.Printf("Error scanning video row: %v", err)
 				continue
 			}
 			video.S3Key = s3Key.String
+			video.ExternalID = externalID.String
+			video.DashKey = dashKey.String
+			video.PreviewKey = previewKey.String
+			video.StatusReason = statusReason.String
+			if video.Status == "processing" && stage.Valid {
+				video.Progress = &VideoProgress{Stage: stage.String, Percent: percent.Float64, UpdatedAt: progressAt.Time}
+				if eta.Valid {
+					secs := int(eta.Int64)
+					video.Progress.ETASeconds = &secs
+				}
+			}
+			video.PosterURL = MediaURL(posterKey.String)
+			video.SpriteURL = MediaURL(spriteKey.String)
+			video.StoryboardURL = MediaURL(storyboardKey.String)
+			if len(thumbnailKeys) > 0 {
+				var keys map[string]string
+				if err := json.Unmarshal(thumbnailKeys, &keys); err == nil && len(keys) > 0 {
+					video.ThumbnailURLs = make(map[string]string, len(keys))
+					for size, key := range keys {
+						video.ThumbnailURLs[size] = MediaURL(key)
+					}
+				}
+			}
+			video.Metadata = meta.value()
 			videos = append(videos, video)
 		}
 
@@ -59,7 +156,30 @@ func GetUserVideosHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func DeleteVideoHandler(db *sql.DB, sess *session.Session) http.HandlerFunc {
+// MediaURL turns a storage key into a public URL. MEDIA_BASE_URL can point at
+// a CDN; by default the bucket's S3 endpoint is used.
+func MediaURL(key string) string {
+	if key == "" {
+		return ""
+	}
+	base := os.Getenv("MEDIA_BASE_URL")
+	if base == "" && os.Getenv("STORAGE_DRIVER") == "local" {
+		base = storage.DefaultLocalBaseURL
+	}
+	if base == "" {
+		base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", os.Getenv("S3_BUCKET_NAME"), os.Getenv("AWS_REGION"))
+	}
+	return strings.TrimSuffix(base, "/") + "/" + key
+}
+
+// Deleted videos are announced on VideoCancelChannel so a worker processing
+// the video stops. The flag key covers workers that miss the message.
+const (
+	VideoCancelChannel = "video_cancel"
+	videoCancelFlagTTL = 24 * time.Hour
+)
+
+func DeleteVideoHandler(db *sql.DB, store storage.Storage, rdb *redis.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := r.Context().Value(UserIDKey).(float64)
 		if !ok {
@@ -84,53 +204,50 @@ func DeleteVideoHandler(db *sql.DB, sess *session.Session) http.HandlerFunc {
 			return
 		}
 
-		if s3Key.Valid && s3Key.String != "" {
-			err = deleteS3Folder(sess, os.Getenv("S3_BUCKET_NAME"), s3Key.String)
-			if err != nil {
-				log.Printf("Failed to delete S3 files for key %s: %v", s3Key.String, err)
-			}
-		}
-
 		_, err = db.Exec("DELETE FROM videos WHERE id = $1 AND user_id = $2", videoID, int(userID))
 		if err != nil {
+			log.Printf("Failed to delete video %d: %v", videoID, err)
 			http.Error(w, "Failed to delete video record", http.StatusInternalServerError)
 			return
 		}
 
+		// Only once the row is gone: a failed delete must leave the video
+		// processing, and the worker cannot recreate the row afterwards.
+		cancelProcessing(r.Context(), rdb, videoID)
+
+		if s3Key.Valid && s3Key.String != "" {
+			err = deleteVideoFiles(r.Context(), store, s3Key.String)
+			if err != nil {
+				log.Printf("Failed to delete files for key %s: %v", s3Key.String, err)
+			}
+		}
+
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Video deleted successfully"})
 	}
 }
 
-func deleteS3Folder(sess *session.Session, bucket string, key string) error {
-	s3Svc := s3.New(sess)
-
-	folderPrefix := strings.TrimSuffix(key, "playlist.m3u8")
-
-	listOutput, err := s3Svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(folderPrefix),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to list S3 objects: %w", err)
+// cancelProcessing tells the workers to stop processing a video. Failures are
+// only logged: the worker also notices the missing row before publishing.
+func cancelProcessing(ctx context.Context, rdb *redis.Client, videoID int) {
+	if err := rdb.Set(ctx, fmt.Sprintf("video_cancel:%d", videoID), 1, videoCancelFlagTTL).Err(); err != nil {
+		log.Printf("Failed to set cancel flag for video %d: %v", videoID, err)
 	}
-
-	if len(listOutput.Contents) == 0 {
-		return nil 
+	if err := rdb.Publish(ctx, VideoCancelChannel, videoID).Err(); err != nil {
+		log.Printf("Failed to publish cancellation for video %d: %v", videoID, err)
 	}
+}
 
-	var objectsToDelete []*s3.ObjectIdentifier
-	for _, object := range listOutput.Contents {
-		objectsToDelete = append(objectsToDelete, &s3.ObjectIdentifier{Key: object.Key})
-	}
-	_, err = s3Svc.DeleteObjects(&s3.DeleteObjectsInput{
-		Bucket: aws.String(bucket),
-		Delete: &s3.Delete{Objects: objectsToDelete},
-	})
+// deleteVideoFiles deletes a video's stored files. The key points at the
+// master playlist; renditions live in subfolders next to it.
+func deleteVideoFiles(ctx context.Context, store storage.Storage, key string) error {
+	folderPrefix := path.Dir(key) + "/"
+	n, err := store.DeletePrefix(ctx, folderPrefix)
 	if err != nil {
-		return fmt.Errorf("failed to delete S3 objects: %w", err)
+		return fmt.Errorf("failed to delete stored files: %w", err)
+	}
+	if n > 0 {
+		log.Printf("Successfully deleted %d files with prefix %s", n, folderPrefix)
 	}
-
-	log.Printf("Successfully deleted %d files from S3 with prefix %s", len(objectsToDelete), folderPrefix)
 	return nil
 }
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"streamify-backend/storage"
+)
+
+func deleteVideo(t *testing.T, fail bool) (*httptest.ResponseRecorder, *miniredis.Miniredis, *fakeDB) {
+	t.Helper()
+	db, fake := newFakeDB(t)
+	fake.setRows("SELECT s3_key FROM videos", []driver.Value{"videos/9/clip.mp4/master.m3u8"})
+	if fail {
+		fake.failExec("DELETE FROM videos", errors.New("connection reset"))
+	}
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	store, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/videos/9", nil)
+	rec := httptest.NewRecorder()
+	DeleteVideoHandler(db, store, rdb).ServeHTTP(rec, withUser(req))
+	return rec, mr, fake
+}
+
+func TestDeleteVideoCancelsProcessing(t *testing.T) {
+	rec, mr, _ := deleteVideo(t, false)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !mr.Exists("video_cancel:9") {
+		t.Error("cancel flag was not set for the deleted video")
+	}
+}
+
+func TestDeleteVideoFailureKeepsProcessing(t *testing.T) {
+	rec, mr, fake := deleteVideo(t, true)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if mr.Exists("video_cancel:9") {
+		t.Error("cancel flag was set although the video was not deleted")
+	}
+	if n := len(fake.execsLike("DELETE FROM videos")); n != 1 {
+		t.Errorf("%d delete attempts, want 1", n)
+	}
+}
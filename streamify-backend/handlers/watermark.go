@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxWatermarkBytes     = 1 << 20
+	maxWatermarkDimension = 4096
+	maxWatermarkText      = 200
+	DefaultWatermarkPos   = "bottom-right"
+)
+
+var watermarkPositions = map[string]bool{
+	"top-left": true, "top-right": true, "bottom-left": true, "bottom-right": true, "center": true,
+}
+
+// previewRenditions are the rungs of the worker's ladder that can be copied
+// into a watermarked preview.
+var previewRenditions = map[string]bool{
+	"1080p": true, "720p": true, "480p": true, "360p": true,
+}
+
+// ErrNoWatermark is returned when an upload asks for the watermark but the
+// owner's organization has none.
+var ErrNoWatermark = errors.New("no watermark has been uploaded")
+
+// WatermarkSettings places the watermark image. Scale is the image width and
+// Margin the distance from the edges, both as a fraction of the video width;
+// Opacity runs from 0 (invisible) to 1.
+type WatermarkSettings struct {
+	Position string  `json:"position"`
+	Scale    float64 `json:"scale"`
+	Opacity  float64 `json:"opacity"`
+	Margin   float64 `json:"margin"`
+}
+
+var defaultWatermarkSettings = WatermarkSettings{Position: DefaultWatermarkPos, Scale: 0.15, Opacity: 0.8, Margin: 0.02}
+
+// WatermarkHandler manages the watermark of the user's organization at
+// /watermark; every member shares it. GET returns the settings, PUT uploads a
+// PNG (multipart field "file") together with any of the position, scale,
+// opacity and margin fields, and DELETE removes it. Uploads opt in to the
+// watermark with the "watermark" field.
+func WatermarkHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(UserIDKey).(float64)
+		if !ok {
+			http.Error(w, "Invalid user ID in token", http.StatusInternalServerError)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			var s WatermarkSettings
+			query := `
+			SELECT w.position, w.scale, w.opacity, w.margin
+			FROM watermarks w JOIN users u ON u.org_id = w.org_id WHERE u.id = $1`
+			err := db.QueryRow(query, int(userID)).Scan(&s.Position, &s.Scale, &s.Opacity, &s.Margin)
+			if err == sql.ErrNoRows {
+				http.Error(w, "No watermark has been uploaded", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to get watermark: %v", err)
+				http.Error(w, "Failed to retrieve watermark", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s)
+
+		case http.MethodPut:
+			r.Body = http.MaxBytesReader(w, r.Body, maxWatermarkBytes+1<<20)
+			if err := r.ParseMultipartForm(maxWatermarkBytes); err != nil {
+				http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+				return
+			}
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			image, err := io.ReadAll(io.LimitReader(file, maxWatermarkBytes+1))
+			if err != nil {
+				http.Error(w, "Error reading the file", http.StatusBadRequest)
+				return
+			}
+			if len(image) > maxWatermarkBytes {
+				http.Error(w, "Watermark image is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err := validWatermarkImage(image); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s, err := parseWatermarkSettings(r.MultipartForm.Value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			orgID, err := userOrg(db, int(userID))
+			if err != nil {
+				log.Printf("Failed to get organization: %v", err)
+				http.Error(w, "Failed to save watermark", http.StatusInternalServerError)
+				return
+			}
+			query := `
+			INSERT INTO watermarks (org_id, image, position, scale, opacity, margin) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (org_id) DO UPDATE SET image = EXCLUDED.image, position = EXCLUDED.position,
+				scale = EXCLUDED.scale, opacity = EXCLUDED.opacity, margin = EXCLUDED.margin, updated_at = NOW()`
+			if _, err := db.Exec(query, orgID, image, s.Position, s.Scale, s.Opacity, s.Margin); err != nil {
+				log.Printf("Failed to save watermark: %v", err)
+				http.Error(w, "Failed to save watermark", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s)
+
+		case http.MethodDelete:
+			query := "DELETE FROM watermarks WHERE org_id = (SELECT org_id FROM users WHERE id = $1)"
+			if _, err := db.Exec(query, int(userID)); err != nil {
+				log.Printf("Failed to delete watermark: %v", err)
+				http.Error(w, "Failed to delete watermark", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// validWatermarkImage checks that the image is a PNG of reasonable size;
+// ffmpeg decodes it again in the worker.
+func validWatermarkImage(image []byte) error {
+	cfg, err := png.DecodeConfig(bytes.NewReader(image))
+	if err != nil {
+		return errors.New("watermark must be a PNG image")
+	}
+	if cfg.Width > maxWatermarkDimension || cfg.Height > maxWatermarkDimension {
+		return fmt.Errorf("watermark must be at most %dx%d pixels", maxWatermarkDimension, maxWatermarkDimension)
+	}
+	return nil
+}
+
+func parseWatermarkSettings(values map[string][]string) (WatermarkSettings, error) {
+	s := defaultWatermarkSettings
+	if v := firstValue(values, "position"); v != "" {
+		s.Position = strings.ToLower(strings.TrimSpace(v))
+	}
+	if !watermarkPositions[s.Position] {
+		return s, errors.New("position must be top-left, top-right, bottom-left, bottom-right or center")
+	}
+	fields := []struct {
+		name     string
+		dst      *float64
+		min, max float64
+	}{
+		{"scale", &s.Scale, 0.01, 1},
+		{"opacity", &s.Opacity, 0, 1},
+		{"margin", &s.Margin, 0, 0.25},
+	}
+	for _, f := range fields {
+		v := firstValue(values, f.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || n < f.min || n > f.max {
+			return s, fmt.Errorf("%s must be a number from %g to %g", f.name, f.min, f.max)
+		}
+		*f.dst = n
+	}
+	return s, nil
+}
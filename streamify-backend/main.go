@@ -3,19 +3,16 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"streamify-backend/handlers"
+	"streamify-backend/outbox"
+	"streamify-backend/storage"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/redis/go-redis/v9"
 
 	_ "github.com/lib/pq"
@@ -28,12 +25,15 @@ type Config struct {
 	DBPassword string
 	DBName     string
 	JWTSecret  string
+	// ContentKeyMaster decrypts the per-video HLS keys; nil when encryption
+	// is not configured.
+	ContentKeyMaster []byte
 }
 
 type Server struct {
 	db      *sql.DB
 	redis   *redis.Client
-	awsSess *session.Session
+	storage storage.Storage
 	config  Config
 }
 
@@ -49,6 +49,14 @@ func main() {
 	if cfg.JWTSecret == "" {
 		log.Fatal("FATAL: JWT_SECRET environment variable not set.")
 	}
+	if v := os.Getenv("CONTENT_KEY_MASTER"); v != "" {
+		master, err := handlers.ParseContentKeyMaster(v)
+		if err != nil {
+			log.Fatal("FATAL: invalid CONTENT_KEY_MASTER: ", err)
+		}
+		cfg.ContentKeyMaster = master
+		handlers.EncryptedOutput = true
+	}
 
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
@@ -80,18 +88,16 @@ func main() {
 	}
 	log.Println("✅ Connected to Redis")
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(os.Getenv("AWS_REGION")),
-	})
+	store, err := storage.FromEnv()
 	if err != nil {
-		log.Fatal("Error creating AWS session:", err)
+		log.Fatal("Error configuring storage:", err)
 	}
-	log.Println("✅ Connected to AWS")
+	log.Println("✅ Storage configured")
 
 	server := &Server{
 		db:      db,
 		redis:   rdb,
-		awsSess: sess,
+		storage: store,
 		config:  cfg,
 	}
 
@@ -99,13 +105,26 @@ func main() {
 		log.Fatal("Error initializing database:", err)
 	}
 
+	go outbox.NewRelay(server.db, server.redis).Run(context.Background())
+
 	// Use a router (mux) to organize handlers
 	mux := http.NewServeMux()
 	mux.HandleFunc("/register", handlers.RegisterHandler(server.db))
 	mux.HandleFunc("/login", handlers.LoginHandler(server.db, server.config.JWTSecret))
-	mux.HandleFunc("/upload", handlers.JWTMiddleware(server.uploadHandler, server.config.JWTSecret))
+	// Integrations upload with an API key instead of a login token.
+	mux.HandleFunc("/upload", handlers.APIKeyMiddleware(server.idempotent(handlers.UploadHandler(server.db)), server.db, server.config.JWTSecret))
+	mux.HandleFunc("/upload/batch", handlers.APIKeyMiddleware(server.idempotent(handlers.BatchUploadHandler(server.db)), server.db, server.config.JWTSecret))
 	mux.HandleFunc("/videos/", handlers.JWTMiddleware(server.videosRouter, server.config.JWTSecret))
+	mux.HandleFunc("/notifications", handlers.JWTMiddleware(handlers.GetNotificationsHandler(server.db), server.config.JWTSecret))
 	mux.HandleFunc("/keys/", handlers.JWTMiddleware(server.keysRouter, server.config.JWTSecret))
+	mux.HandleFunc("/watermark", handlers.JWTMiddleware(handlers.WatermarkHandler(server.db), server.config.JWTSecret))
+	// Players authenticate key requests with a playback token, not a login JWT.
+	mux.HandleFunc("/content-keys/", handlers.ContentKeyHandler(server.db, server.config.JWTSecret, server.config.ContentKeyMaster))
+	mux.HandleFunc("/playback/", handlers.PlaybackPlaylistHandler(server.db, store, server.config.JWTSecret))
+	// The local storage driver serves media itself, standing in for S3.
+	if local, ok := store.(*storage.Local); ok {
+		mux.Handle("/media/", http.StripPrefix("/media", local.FileServer()))
+	}
 
 	// Wrap the entire mux with the CORS middleware
 	handler := handlers.CORSMiddleware(mux)
@@ -114,13 +133,30 @@ func main() {
 	log.Fatal(http.ListenAndServe(":8080", handler))
 }
 
+// idempotent lets clients safely retry a mutating request by sending an Idempotency-Key header.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return handlers.IdempotencyMiddleware(next, s.redis)
+}
+
 func (s *Server) videosRouter(w http.ResponseWriter, r *http.Request) {
 	if (r.URL.Path == "/videos" || r.URL.Path == "/videos/") && r.Method == http.MethodGet {
 		handlers.GetUserVideosHandler(s.db)(w, r)
 		return
 	}
+	if strings.HasSuffix(r.URL.Path, "/metadata") && r.Method == http.MethodGet {
+		handlers.GetVideoMetadataHandler(s.db)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/captions") && r.Method == http.MethodPost {
+		s.idempotent(handlers.UploadCaptionHandler(s.db))(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/playback-token") && r.Method == http.MethodPost {
+		handlers.PlaybackTokenHandler(s.db, s.config.JWTSecret)(w, r)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/videos/") && r.Method == http.MethodDelete {
-		handlers.DeleteVideoHandler(s.db, s.awsSess)(w, r)
+		s.idempotent(handlers.DeleteVideoHandler(s.db, s.storage, s.redis))(w, r)
 		return
 	}
 	http.NotFound(w, r)
@@ -132,72 +168,15 @@ func (s *Server) keysRouter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if (r.URL.Path == "/keys" || r.URL.Path == "/keys/") && r.Method == http.MethodPost {
-		handlers.GenerateAPIKeyHandler(s.db)(w, r)
-		return
-	}
-	http.NotFound(w, r)
-}
-
-func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
-	userID, ok := r.Context().Value(handlers.UserIDKey).(float64)
-	if !ok {
-		http.Error(w, "Could not get user ID from token", http.StatusInternalServerError)
-		return
-	}
-
-	r.ParseMultipartForm(32 << 20)
-	file, handler, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Error retrieving the file", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	uploadPath := filepath.Join("/app/uploads", handler.Filename)
-	dst, err := os.Create(uploadPath)
-	if err != nil {
-		http.Error(w, "Error creating the file", http.StatusInternalServerError)
-		return
-	}
-	defer dst.Close()
-
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Error saving the file", http.StatusInternalServerError)
-		return
-	}
-
-	originalFilename := handler.Filename
-	extension := filepath.Ext(originalFilename)
-	videoTitle := strings.TrimSuffix(originalFilename, extension)
-
-	var videoID int
-	insertQuery := `INSERT INTO videos (user_id, filename, title, status) VALUES ($1, $2, $3, 'processing') RETURNING id`
-	err = s.db.QueryRow(insertQuery, int(userID), handler.Filename, videoTitle).Scan(&videoID)
-	if err != nil {
-		log.Printf("DB insert error: %v", err)
-		http.Error(w, "Failed to create video record", http.StatusInternalServerError)
-		return
-	}
-
-	jobPayload := map[string]interface{}{
-		"filename": handler.Filename,
-		"video_id": videoID,
-	}
-	jobJSON, err := json.Marshal(jobPayload)
-	if err != nil {
-		http.Error(w, "Error creating job payload", http.StatusInternalServerError)
+		// The response holds the plaintext key, which must not be cached.
+		handlers.SecretIdempotencyMiddleware(handlers.GenerateAPIKeyHandler(s.db), s.redis)(w, r)
 		return
 	}
-
-	err = s.redis.LPush(context.Background(), "video_jobs", jobJSON).Err()
-	if err != nil {
-		http.Error(w, "Failed to enqueue job", http.StatusInternalServerError)
+	if (r.URL.Path == "/keys" || r.URL.Path == "/keys/") && r.Method == http.MethodPut {
+		handlers.SetAPIKeyPriorityHandler(s.db)(w, r)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{"message": "File uploaded and processing started."})
+	http.NotFound(w, r)
 }
 
 func (s *Server) initDB() error {
@@ -210,6 +189,16 @@ func (s *Server) initDB() error {
         created_at TIMESTAMPTZ DEFAULT NOW()
     );`
 
+	// Organizations own the assets their members share, such as the
+	// watermark. Users get a personal organization when they first need one.
+	createOrganizationsTable := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS org_id INTEGER REFERENCES organizations(id) ON DELETE SET NULL;`
+
 	createVideosTable := `
     CREATE TABLE IF NOT EXISTS videos (
         id SERIAL PRIMARY KEY,
@@ -221,6 +210,28 @@ func (s *Server) initDB() error {
         created_at TIMESTAMPTZ DEFAULT NOW()
     );`
 
+	alterVideosTable := `
+	ALTER TABLE videos
+		ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}',
+		ADD COLUMN IF NOT EXISTS visibility TEXT NOT NULL DEFAULT 'private',
+		ADD COLUMN IF NOT EXISTS external_id TEXT,
+		ADD COLUMN IF NOT EXISTS encoding_profile TEXT NOT NULL DEFAULT 'standard',
+		ADD COLUMN IF NOT EXISTS status_reason TEXT,
+		ADD COLUMN IF NOT EXISTS progress_stage TEXT,
+		ADD COLUMN IF NOT EXISTS progress_percent REAL,
+		ADD COLUMN IF NOT EXISTS progress_eta_seconds INTEGER,
+		ADD COLUMN IF NOT EXISTS progress_updated_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS poster_key TEXT,
+		ADD COLUMN IF NOT EXISTS thumbnail_keys JSONB,
+		ADD COLUMN IF NOT EXISTS sprite_key TEXT,
+		ADD COLUMN IF NOT EXISTS storyboard_key TEXT,
+		ADD COLUMN IF NOT EXISTS output_format TEXT NOT NULL DEFAULT 'hls',
+		ADD COLUMN IF NOT EXISTS dash_key TEXT,
+		ADD COLUMN IF NOT EXISTS preview_key TEXT;
+	CREATE UNIQUE INDEX IF NOT EXISTS videos_user_external_id_idx
+		ON videos (user_id, external_id) WHERE external_id IS NOT NULL;`
+
 	createAPIKeysTable := `
 	CREATE TABLE IF NOT EXISTS api_keys (
 		id SERIAL PRIMARY KEY,
@@ -228,6 +239,75 @@ func (s *Server) initDB() error {
 		key_hash TEXT NOT NULL,
 		last_four TEXT NOT NULL,
 		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+	ALTER TABLE api_keys
+		ADD COLUMN IF NOT EXISTS key_lookup TEXT UNIQUE,
+		ADD COLUMN IF NOT EXISTS priority TEXT;`
+
+	createNotificationsTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		video_id INTEGER REFERENCES videos(id) ON DELETE SET NULL,
+		kind TEXT NOT NULL,
+		message TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		read_at TIMESTAMPTZ
+	);`
+
+	createVideoMetadataTable := `
+	CREATE TABLE IF NOT EXISTS video_metadata (
+		video_id INTEGER PRIMARY KEY REFERENCES videos(id) ON DELETE CASCADE,
+		duration_seconds DOUBLE PRECISION,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		frame_rate DOUBLE PRECISION,
+		video_codec TEXT,
+		audio_codec TEXT,
+		audio_channels INTEGER,
+		bit_rate BIGINT,
+		size_bytes BIGINT,
+		container TEXT,
+		probe JSONB NOT NULL,
+		probed_at TIMESTAMPTZ DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS video_metadata_height_idx ON video_metadata (height);
+	ALTER TABLE video_metadata ADD COLUMN IF NOT EXISTS audio_tracks JSONB;`
+
+	// Caption tracks are stored as WebVTT, whether uploaded or extracted from
+	// the source by the worker.
+	createVideoCaptionsTable := `
+	CREATE TABLE IF NOT EXISTS video_captions (
+		id SERIAL PRIMARY KEY,
+		video_id INTEGER NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+		language TEXT NOT NULL,
+		label TEXT NOT NULL,
+		source TEXT NOT NULL DEFAULT 'upload',
+		vtt TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		UNIQUE (video_id, language, label)
+	);`
+
+	// Content keys are sealed with CONTENT_KEY_MASTER by the worker and only
+	// ever leave the database through the content key endpoint.
+	createVideoKeysTable := `
+	CREATE TABLE IF NOT EXISTS video_keys (
+		video_id INTEGER PRIMARY KEY REFERENCES videos(id) ON DELETE CASCADE,
+		encrypted_key BYTEA NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);`
+
+	// Watermark images are small PNGs the worker overlays on opted-in uploads.
+	// Each organization has one, used for all of its members' uploads.
+	createWatermarksTable := `
+	CREATE TABLE IF NOT EXISTS watermarks (
+		org_id INTEGER PRIMARY KEY REFERENCES organizations(id) ON DELETE CASCADE,
+		image BYTEA NOT NULL,
+		position TEXT NOT NULL DEFAULT 'bottom-right',
+		scale DOUBLE PRECISION NOT NULL DEFAULT 0.15,
+		opacity DOUBLE PRECISION NOT NULL DEFAULT 0.8,
+		margin DOUBLE PRECISION NOT NULL DEFAULT 0.02,
+		updated_at TIMESTAMPTZ DEFAULT NOW()
 	);`
 
 	_, err := s.db.Exec(createUsersTable)
@@ -235,16 +315,55 @@ func (s *Server) initDB() error {
 		return fmt.Errorf("error creating users table: %w", err)
 	}
 
+	_, err = s.db.Exec(createOrganizationsTable)
+	if err != nil {
+		return fmt.Errorf("error creating organizations table: %w", err)
+	}
+
 	_, err = s.db.Exec(createVideosTable)
 	if err != nil {
 		return fmt.Errorf("error creating videos table: %w", err)
 	}
 
+	_, err = s.db.Exec(alterVideosTable)
+	if err != nil {
+		return fmt.Errorf("error migrating videos table: %w", err)
+	}
+
 	_, err = s.db.Exec(createAPIKeysTable)
 	if err != nil {
 		return fmt.Errorf("error creating api_keys table: %w", err)
 	}
 
+	_, err = s.db.Exec(createVideoMetadataTable)
+	if err != nil {
+		return fmt.Errorf("error creating video_metadata table: %w", err)
+	}
+
+	_, err = s.db.Exec(createNotificationsTable)
+	if err != nil {
+		return fmt.Errorf("error creating notifications table: %w", err)
+	}
+
+	_, err = s.db.Exec(createVideoKeysTable)
+	if err != nil {
+		return fmt.Errorf("error creating video_keys table: %w", err)
+	}
+
+	_, err = s.db.Exec(createVideoCaptionsTable)
+	if err != nil {
+		return fmt.Errorf("error creating video_captions table: %w", err)
+	}
+
+	_, err = s.db.Exec(createWatermarksTable)
+	if err != nil {
+		return fmt.Errorf("error creating watermarks table: %w", err)
+	}
+
+	if err := outbox.InitDB(s.db); err != nil {
+		return err
+	}
+
 	log.Println("✅ Database tables checked/created successfully.")
 	return nil
 }
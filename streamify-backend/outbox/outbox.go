@@ -0,0 +1,161 @@
+// Package outbox implements a transactional outbox: jobs are written to
+// Postgres in the same transaction as the rows they refer to, and a relay
+// publishes them to Redis afterwards. Delivery is at-least-once, so consumers
+// must be idempotent.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const createTable = `
+	CREATE TABLE IF NOT EXISTS job_outbox (
+		id BIGSERIAL PRIMARY KEY,
+		queue TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		published_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS job_outbox_pending_idx ON job_outbox (id) WHERE published_at IS NULL;`
+
+// InitDB creates the outbox table if it does not exist.
+func InitDB(db *sql.DB) error {
+	if _, err := db.Exec(createTable); err != nil {
+		return fmt.Errorf("error creating job_outbox table: %w", err)
+	}
+	return nil
+}
+
+// Enqueue records a job for queue inside tx. It becomes visible to the relay
+// only once tx commits.
+func Enqueue(tx *sql.Tx, queue string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox payload: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO job_outbox (queue, payload) VALUES ($1, $2)`, queue, data)
+	return err
+}
+
+// Relay moves committed outbox entries onto their Redis queues.
+type Relay struct {
+	DB        *sql.DB
+	Redis     *redis.Client
+	Interval  time.Duration
+	BatchSize int
+	// Retention is how long published entries are kept before being purged.
+	Retention time.Duration
+}
+
+func NewRelay(db *sql.DB, rdb *redis.Client) *Relay {
+	return &Relay{
+		DB:        db,
+		Redis:     rdb,
+		Interval:  time.Second,
+		BatchSize: 100,
+		Retention: 7 * 24 * time.Hour,
+	}
+}
+
+// Run publishes pending entries until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	lastPurge := time.Time{}
+
+	for {
+		for {
+			n, err := r.publishBatch(ctx)
+			if err != nil {
+				log.Printf("Outbox relay error: %v", err)
+				break
+			}
+			if n < r.BatchSize {
+				break
+			}
+		}
+
+		if time.Since(lastPurge) > time.Hour {
+			if _, err := r.DB.ExecContext(ctx, `DELETE FROM job_outbox WHERE published_at < $1`, time.Now().Add(-r.Retention)); err != nil {
+				log.Printf("Outbox purge error: %v", err)
+			}
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishBatch locks up to BatchSize pending entries, pushes them to Redis and
+// marks them published. SKIP LOCKED lets several backend replicas run relays
+// side by side. If the process dies between LPush and COMMIT the entries are
+// published again, which is why delivery is at-least-once.
+func (r *Relay) publishBatch(ctx context.Context) (int, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, queue, payload FROM job_outbox
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, r.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type entry struct {
+		id      int64
+		queue   string
+		payload []byte
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.queue, &e.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, e := range entries {
+		if err := r.Redis.LPush(ctx, e.queue, e.payload).Err(); err != nil {
+			if _, dbErr := tx.ExecContext(ctx, `UPDATE job_outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2`, err.Error(), e.id); dbErr != nil {
+				return published, dbErr
+			}
+			// Redis is most likely down; leave the rest for the next tick.
+			break
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE job_outbox SET published_at = NOW(), attempts = attempts + 1 WHERE id = $1`, e.id); err != nil {
+			return published, err
+		}
+		published++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return published, nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLocalDir     = "/app/media"
+	DefaultLocalBaseURL = "http://localhost:8080/media"
+)
+
+// localContentTypes covers the media types Go's mime table does not know.
+var localContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".vtt":  "text/vtt; charset=utf-8",
+}
+
+// Local keeps objects as files under a root directory, for development. The
+// worker writes them; the backend serves them and deletes them with their
+// video.
+type Local struct {
+	root    string
+	baseURL string
+}
+
+func NewLocal(root, baseURL string) (*Local, error) {
+	root = filepath.Clean(root)
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating storage directory: %w", err)
+	}
+	return &Local{root: root, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// Get opens the file of a key. The key is cleaned first, so it cannot name a
+// file outside the root.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+key))))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// List walks the deepest directory the prefix names and filters by prefix.
+// Files the worker is still writing are skipped.
+func (l *Local) List(ctx context.Context, prefix string) ([]string, error) {
+	dir := path.Dir(path.Clean("/" + prefix))
+	if strings.HasSuffix(prefix, "/") {
+		dir = path.Clean("/" + prefix)
+	}
+	var keys []string
+	err := filepath.WalkDir(filepath.Join(l.root, filepath.FromSlash(dir)), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return err
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return ctx.Err()
+	})
+	return keys, err
+}
+
+// DeletePrefix removes every file whose key starts with prefix, then any
+// directories left empty, up to the root.
+func (l *Local) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	keys, err := l.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, key := range keys {
+		p := filepath.Join(l.root, filepath.FromSlash(key))
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return deleted, err
+		}
+		deleted++
+		for dir := filepath.Dir(p); dir != l.root && strings.HasPrefix(dir, l.root); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// Presign returns the object's plain URL: the development file server does
+// not check access, so there is nothing to sign.
+func (l *Local) Presign(key string, ttl time.Duration) (string, error) {
+	return l.baseURL + "/" + strings.TrimPrefix(key, "/"), nil
+}
+
+// FileServer serves the stored objects, for mounting at the path of the
+// base URL with http.StripPrefix. Directory listings are not served.
+func (l *Local) FileServer() http.Handler {
+	files := http.FileServer(http.Dir(l.root))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if ct, ok := localContentTypes[strings.ToLower(path.Ext(r.URL.Path))]; ok {
+			w.Header().Set("Content-Type", ct)
+		}
+		files.ServeHTTP(w, r)
+	})
+}
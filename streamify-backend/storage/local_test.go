@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestLocal returns a Local holding the given keys, each containing its
+// own key.
+func newTestLocal(t *testing.T, keys ...string) *Local {
+	t.Helper()
+	l, err := NewLocal(t.TempDir(), "http://localhost:8080/media/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		p := filepath.Join(l.root, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(key), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l
+}
+
+func TestLocalList(t *testing.T) {
+	l := newTestLocal(t, "videos/1/master.m3u8", "videos/1/720p/segment0.ts", "videos/12/master.m3u8", "videos/1/.upload-123")
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"videos/1/", []string{"videos/1/720p/segment0.ts", "videos/1/master.m3u8"}},
+		{"videos/1", []string{"videos/1/720p/segment0.ts", "videos/1/master.m3u8", "videos/12/master.m3u8"}},
+		{"videos/3/", nil},
+	}
+	for _, tt := range tests {
+		got, err := l.List(context.Background(), tt.prefix)
+		if err != nil {
+			t.Fatalf("List(%q) error = %v", tt.prefix, err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestLocalDeletePrefix(t *testing.T) {
+	l := newTestLocal(t, "videos/1/master.m3u8", "videos/1/720p/segment0.ts", "videos/12/master.m3u8")
+	n, err := l.DeletePrefix(context.Background(), "videos/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("DeletePrefix() = %d, want 2", n)
+	}
+	if _, err := os.Stat(filepath.Join(l.root, "videos/1")); !os.IsNotExist(err) {
+		t.Error("empty directories were left behind")
+	}
+	if keys, _ := l.List(context.Background(), "videos/"); !reflect.DeepEqual(keys, []string{"videos/12/master.m3u8"}) {
+		t.Errorf("remaining keys = %v, want only video 12", keys)
+	}
+}
+
+func TestLocalPresignIsServed(t *testing.T) {
+	l := newTestLocal(t, "videos/1/master.m3u8")
+	url, err := l.Presign("videos/1/master.m3u8", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://localhost:8080/media/videos/1/master.m3u8"; url != want {
+		t.Fatalf("Presign() = %q, want %q", url, want)
+	}
+
+	server := http.StripPrefix("/media", l.FileServer())
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "videos/1/master.m3u8" {
+		t.Errorf("GET %s = %d %q, want the stored playlist", url, rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("Content-Type = %q, want the HLS playlist type", ct)
+	}
+}
+
+func TestLocalGet(t *testing.T) {
+	l := newTestLocal(t, "videos/1/master.m3u8")
+	f, err := l.Get(context.Background(), "videos/1/master.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(f)
+	f.Close()
+	if string(body) != "videos/1/master.m3u8" {
+		t.Errorf("Get() = %q, want the stored playlist", body)
+	}
+	if _, err := l.Get(context.Background(), "videos/1/../../missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a missing key error = %v, want ErrNotFound", err)
+	}
+}
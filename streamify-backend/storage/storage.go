@@ -0,0 +1,61 @@
+// Package storage abstracts where processed media lives. The S3 driver is
+// used in production; the local driver keeps files on disk and serves them
+// over HTTP so Streamify can run without AWS during development.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Storage is an object store addressed by slash-separated keys. The worker
+// publishes media into it; the backend reads and removes it.
+type Storage interface {
+	// Get opens an object for reading, or returns ErrNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns every key that starts with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// DeletePrefix deletes every key that starts with prefix and returns how
+	// many were deleted.
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
+	// Presign returns a URL that allows reading key until ttl has passed.
+	Presign(key string, ttl time.Duration) (string, error)
+}
+
+// ErrNotFound is returned by Get for a key that does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// FromEnv returns the driver selected by STORAGE_DRIVER: "s3" (the default,
+// using S3_BUCKET_NAME and AWS_REGION) or "local" (using LOCAL_STORAGE_DIR
+// and MEDIA_BASE_URL).
+func FromEnv() (Storage, error) {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "s3":
+		sess, err := session.NewSession(&aws.Config{
+			Region: aws.String(os.Getenv("AWS_REGION")),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating AWS session: %w", err)
+		}
+		return NewS3(sess, os.Getenv("S3_BUCKET_NAME")), nil
+	case "local":
+		dir := os.Getenv("LOCAL_STORAGE_DIR")
+		if dir == "" {
+			dir = DefaultLocalDir
+		}
+		baseURL := os.Getenv("MEDIA_BASE_URL")
+		if baseURL == "" {
+			baseURL = DefaultLocalBaseURL
+		}
+		return NewLocal(dir, baseURL)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The backend announces deleted videos on cancelChannel and also sets a
+// per-video flag, which covers messages missed while reconnecting.
+const (
+	cancelChannel      = "video_cancel"
+	cancelPollInterval = 10 * time.Second
+)
+
+func cancelFlagKey(videoID int) string {
+	return fmt.Sprintf("video_cancel:%d", videoID)
+}
+
+// errVideoDeleted is the cancellation cause of a job whose video was deleted.
+var errVideoDeleted = errors.New("video was deleted")
+
+// cancellations tracks the running jobs that can be cancelled by video ID.
+type cancellations struct {
+	mu   sync.Mutex
+	jobs map[int]context.CancelCauseFunc
+}
+
+func newCancellations() *cancellations {
+	return &cancellations{jobs: map[int]context.CancelCauseFunc{}}
+}
+
+// register returns a context that is cancelled with errVideoDeleted when the
+// video is deleted. done must be called when the job ends.
+func (c *cancellations) register(ctx context.Context, videoID int) (jobCtx context.Context, done func()) {
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	c.mu.Lock()
+	c.jobs[videoID] = cancel
+	c.mu.Unlock()
+	return jobCtx, func() {
+		c.mu.Lock()
+		delete(c.jobs, videoID)
+		c.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+func (c *cancellations) cancel(videoID int) bool {
+	c.mu.Lock()
+	cancel, ok := c.jobs[videoID]
+	c.mu.Unlock()
+	if ok {
+		cancel(errVideoDeleted)
+	}
+	return ok
+}
+
+func (c *cancellations) active() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]int, 0, len(c.jobs))
+	for id := range c.jobs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// watchCancellations cancels running jobs whose video is deleted, listening on
+// cancelChannel and polling the cancel flags of active jobs as a fallback.
+// It returns when ctx is cancelled.
+func (w *Worker) watchCancellations(ctx context.Context) {
+	sub := w.rdb.Subscribe(ctx, cancelChannel)
+	defer sub.Close()
+	messages := sub.Channel()
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			videoID, err := strconv.Atoi(msg.Payload)
+			if err != nil {
+				continue
+			}
+			if w.cancels.cancel(videoID) {
+				log.Printf("🛑 Cancelling job for deleted video ID %d", videoID)
+			}
+		case <-ticker.C:
+			for _, videoID := range w.cancels.active() {
+				n, err := w.rdb.Exists(ctx, cancelFlagKey(videoID)).Result()
+				if err == nil && n > 0 && w.cancels.cancel(videoID) {
+					log.Printf("🛑 Cancelling job for deleted video ID %d", videoID)
+				}
+			}
+		}
+	}
+}
+
+// cleanupDeletedVideo removes what a cancelled job left behind: the source
+// file and any objects uploaded under the video's prefix, including ones
+// uploaded after the backend deleted the prefix.
+func (w *Worker) cleanupDeletedVideo(ctx context.Context, job VideoJob) {
+	if job.Filename != "" {
+		os.Remove(sourcePath(job))
+	}
+	w.rdb.Del(ctx, uploadManifestKey(job.VideoID))
+	prefix := fmt.Sprintf("videos/%d/", job.VideoID)
+	n, err := w.storage.DeletePrefix(ctx, prefix)
+	if err != nil {
+		log.Printf("❌ Failed to clean up stored files for deleted video ID %d: %v", job.VideoID, err)
+		return
+	}
+	log.Printf("🗑️ Cleaned up deleted video ID %d (%d stored files)", job.VideoID, n)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TaskCaptions marks jobs that only publish a video's caption tracks.
+const TaskCaptions = "captions"
+
+const (
+	subtitleGroupID = "subs"
+	subtitlesDir    = "subs"
+)
+
+// textSubtitleCodecs are the embedded subtitle formats ffmpeg can convert to
+// WebVTT. Bitmap formats such as PGS and DVB need OCR and are skipped.
+var textSubtitleCodecs = map[string]bool{
+	"mov_text": true,
+	"subrip":   true,
+	"webvtt":   true,
+}
+
+// Caption is a WebVTT track from the video_captions table.
+type Caption struct {
+	ID       int
+	Language string
+	Label    string
+	VTT      string
+}
+
+func loadCaptions(db *sql.DB, videoID int) ([]Caption, error) {
+	rows, err := db.Query(`SELECT id, language, label, vtt FROM video_captions WHERE video_id = $1 ORDER BY id`, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var captions []Caption
+	for rows.Next() {
+		var c Caption
+		if err := rows.Scan(&c.ID, &c.Language, &c.Label, &c.VTT); err != nil {
+			return nil, err
+		}
+		captions = append(captions, c)
+	}
+	return captions, rows.Err()
+}
+
+// extractEmbeddedCaptions converts the source's text subtitle streams to
+// WebVTT and stores them, replacing tracks extracted by an earlier attempt.
+// Uploaded tracks with the same language and label take precedence.
+func extractEmbeddedCaptions(ctx context.Context, db *sql.DB, ffmpeg *ffmpegRunner, videoID int, inputPath, scratchDir string, src SourceInfo) error {
+	type extracted struct{ language, label, vtt string }
+	var found []extracted
+	for i, t := range src.SubtitleTracks {
+		if !textSubtitleCodecs[t.Codec] {
+			continue
+		}
+		out := filepath.Join(scratchDir, fmt.Sprintf("embedded_%d.vtt", i))
+		// Each pass demuxes the whole source, so it counts against the
+		// ffmpeg limit like a transcode.
+		if err := ffmpeg.slots.acquire(ctx); err != nil {
+			return err
+		}
+		err := ffmpeg.quiet(ctx, src.Duration, "-y", "-i", inputPath, "-map", fmt.Sprintf("0:s:%d", i), "-c:s", "webvtt", out)
+		ffmpeg.slots.release()
+		if err != nil {
+			return fmt.Errorf("failed to extract subtitle stream %d: %w", i, err)
+		}
+		vtt, err := os.ReadFile(out)
+		if err != nil {
+			return err
+		}
+		language := t.Language
+		if language == "" {
+			language = "und"
+		}
+		label := t.Title
+		if label == "" {
+			label = fmt.Sprintf("%s (%d)", language, i+1)
+		}
+		found = append(found, extracted{language, label, string(vtt)})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM video_captions WHERE video_id = $1 AND source = 'embedded'`, videoID); err != nil {
+		return err
+	}
+	for _, e := range found {
+		_, err := tx.Exec(`
+		INSERT INTO video_captions (video_id, language, label, source, vtt) VALUES ($1, $2, $3, 'embedded', $4)
+		ON CONFLICT (video_id, language, label) DO NOTHING`, videoID, e.language, e.label, e.vtt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// vttCue is one cue block, kept verbatim apart from its parsed timing.
+type vttCue struct {
+	Start, End time.Duration
+	Block      string
+}
+
+var vttTimingPattern = regexp.MustCompile(`^((?:\d+:)?\d{2}:\d{2}\.\d{3})\s+-->\s+((?:\d+:)?\d{2}:\d{2}\.\d{3})`)
+
+// parseVTTCues returns the cues of a WebVTT file, skipping the header and
+// NOTE, STYLE and REGION blocks.
+func parseVTTCues(vtt string) []vttCue {
+	vtt = strings.ReplaceAll(vtt, "\r\n", "\n")
+	var cues []vttCue
+	for _, block := range strings.Split(vtt, "\n\n") {
+		block = strings.Trim(block, "\n")
+		lines := strings.Split(block, "\n")
+		for i, line := range lines {
+			m := vttTimingPattern.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			start, err1 := parseVTTTimestamp(m[1])
+			end, err2 := parseVTTTimestamp(m[2])
+			if err1 == nil && err2 == nil {
+				cues = append(cues, vttCue{Start: start, End: end, Block: strings.Join(lines[i:], "\n")})
+			}
+			break
+		}
+	}
+	return cues
+}
+
+func parseVTTTimestamp(ts string) (time.Duration, error) {
+	parts := strings.Split(ts, ":")
+	var d time.Duration
+	for _, p := range parts[:len(parts)-1] {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, err
+		}
+		d = d*60 + time.Duration(n)
+	}
+	secs, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return d*60*time.Second + time.Duration(secs*float64(time.Second)), nil
+}
+
+// subtitleTimestampOffset is the X-TIMESTAMP-MAP MPEGTS value (90 kHz) that
+// lines the cues up with the video. ffmpeg's MPEG-TS segments start at 1.4s;
+// fMP4 segments start at zero.
+func subtitleTimestampOffset(fmp4 bool) int {
+	if fmp4 {
+		return 0
+	}
+	return 126000
+}
+
+// writeSubtitleRenditions splits each caption track into WebVTT segments of
+// hlsSegmentSeconds under outputDir/subs/<id>/, each with a media playlist.
+// A cue spanning a segment boundary is repeated in both segments, as HLS
+// players expect.
+func writeSubtitleRenditions(outputDir string, captions []Caption, duration time.Duration, fmp4 bool) error {
+	header := fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", subtitleTimestampOffset(fmp4))
+	segment := time.Duration(hlsSegmentSeconds) * time.Second
+	for _, c := range captions {
+		cues := parseVTTCues(c.VTT)
+		total := duration
+		if total <= 0 {
+			for _, cue := range cues {
+				if cue.End > total {
+					total = cue.End
+				}
+			}
+		}
+		count := int(math.Ceil(float64(total) / float64(segment)))
+		if count < 1 {
+			count = 1
+		}
+
+		dir := filepath.Join(outputDir, subtitlesDir, strconv.Itoa(c.ID))
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+		var playlist strings.Builder
+		fmt.Fprintf(&playlist, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", hlsSegmentSeconds)
+		for i := 0; i < count; i++ {
+			start := time.Duration(i) * segment
+			end := start + segment
+			if i == count-1 && total > start {
+				end = total
+			}
+			var b strings.Builder
+			b.WriteString(header)
+			for _, cue := range cues {
+				if cue.Start < end && cue.End > start {
+					b.WriteString("\n" + cue.Block + "\n")
+				}
+			}
+			name := fmt.Sprintf("segment%d.vtt", i)
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(b.String()), 0o644); err != nil {
+				return err
+			}
+			fmt.Fprintf(&playlist, "#EXTINF:%s,\n%s\n", formatSeconds(end-start), name)
+		}
+		playlist.WriteString("#EXT-X-ENDLIST\n")
+		if err := os.WriteFile(filepath.Join(dir, "playlist.m3u8"), []byte(playlist.String()), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withSubtitles returns the master playlist with its subtitle group replaced
+// by the given caption tracks: one EXT-X-MEDIA TYPE=SUBTITLES entry per track,
+// referenced from every variant. The DASH manifest of CMAF output is left as
+// is.
+func withSubtitles(master string, captions []Caption) string {
+	var media []string
+	for _, c := range captions {
+		line := fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\"", subtitleGroupID, quotedAttr(c.Label))
+		if c.Language != "" && c.Language != "und" {
+			line += fmt.Sprintf(",LANGUAGE=\"%s\"", quotedAttr(c.Language))
+		}
+		line += fmt.Sprintf(",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI=\"%s/%d/playlist.m3u8\"", subtitlesDir, c.ID)
+		media = append(media, line)
+	}
+
+	attr := fmt.Sprintf(",SUBTITLES=\"%s\"", subtitleGroupID)
+	var out []string
+	inserted := false
+	for _, line := range strings.Split(strings.TrimRight(master, "\n"), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA:TYPE=SUBTITLES") {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			if !inserted {
+				out = append(out, media...)
+				inserted = true
+			}
+			line = strings.Replace(line, attr, "", 1)
+			if len(media) > 0 {
+				line += attr
+			}
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// quotedAttr makes s safe for a playlist quoted-string, which cannot contain
+// double quotes or line breaks.
+func quotedAttr(s string) string {
+	return strings.NewReplacer("\"", "'", "\n", " ", "\r", " ").Replace(s)
+}
+
+// addCaptions extracts embedded subtitles, then writes every caption track of
+// the video into outputDir and references them from the master playlist.
+func (w *Worker) addCaptions(ctx context.Context, job VideoJob, inputPath, outputDir string, src SourceInfo, fmp4 bool) error {
+	// Extracted files go to their own directory; outputDir is uploaded as is.
+	extractDir, err := os.MkdirTemp(w.scratchDir, fmt.Sprintf("subs-%d-*", job.VideoID))
+	if err != nil {
+		return retryableError("could not create scratch directory", err)
+	}
+	defer os.RemoveAll(extractDir)
+	if err := extractEmbeddedCaptions(ctx, w.db, w.ffmpeg, job.VideoID, inputPath, extractDir, src); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		// Uploaded captions can still be published without the embedded ones.
+		log.Printf("⚠️ Failed to extract embedded subtitles for video ID %d: %v", job.VideoID, err)
+	}
+	captions, err := loadCaptions(w.db, job.VideoID)
+	if err != nil {
+		return retryableError("could not load captions", err)
+	}
+	if len(captions) == 0 {
+		return nil
+	}
+	if err := writeSubtitleRenditions(outputDir, captions, src.Duration, fmp4); err != nil {
+		return retryableError("could not write subtitle renditions", err)
+	}
+	for _, name := range []string{masterPlaylistName, previewPlaylistName} {
+		p := filepath.Join(outputDir, name)
+		master, err := os.ReadFile(p)
+		if os.IsNotExist(err) && name == previewPlaylistName {
+			continue
+		}
+		if err != nil {
+			return retryableError("could not read master playlist", err)
+		}
+		if err := os.WriteFile(p, []byte(withSubtitles(string(master), captions)), 0o644); err != nil {
+			return retryableError("could not write master playlist", err)
+		}
+	}
+	log.Printf("💬 Added %d caption tracks to video ID %d", len(captions), job.VideoID)
+	return nil
+}
+
+// publishCaptions republishes the caption tracks of a video that is already
+// ready: it writes the subtitle renditions, patches the stored master and
+// preview playlists and uploads them. Videos still processing pick their captions up
+// when the transcode finishes.
+func (w *Worker) publishCaptions(ctx context.Context, job VideoJob) error {
+	var status, profile, format string
+	var masterKey, previewKey sql.NullString
+	var durationSecs sql.NullFloat64
+	err := w.db.QueryRow(`
+	SELECT v.status, v.s3_key, v.preview_key, v.encoding_profile, v.output_format, m.duration_seconds
+	FROM videos v LEFT JOIN video_metadata m ON m.video_id = v.id
+	WHERE v.id = $1`, job.VideoID).Scan(&status, &masterKey, &previewKey, &profile, &format, &durationSecs)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return retryableError("could not look up video", err)
+	}
+	if status != "ready" || !masterKey.Valid {
+		log.Printf("⏭️ Captions for video ID %d will be published with the video (status %s)", job.VideoID, status)
+		return nil
+	}
+
+	captions, err := loadCaptions(w.db, job.VideoID)
+	if err != nil {
+		return retryableError("could not load captions", err)
+	}
+	outputDir, err := os.MkdirTemp(w.scratchDir, fmt.Sprintf("captions-%d-*", job.VideoID))
+	if err != nil {
+		return retryableError("could not create scratch directory", err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	fmp4 := format == FormatCMAF || lookupProfile(profile).needsFMP4()
+	duration := time.Duration(durationSecs.Float64 * float64(time.Second))
+	if err := writeSubtitleRenditions(outputDir, captions, duration, fmp4); err != nil {
+		return retryableError("could not write subtitle renditions", err)
+	}
+
+	playlists := map[string]string{masterPlaylistName: masterKey.String}
+	if previewKey.Valid {
+		playlists[previewPlaylistName] = previewKey.String
+	}
+	for name, key := range playlists {
+		obj, err := w.storage.Get(ctx, key)
+		if err != nil {
+			return retryableError("could not download master playlist", err)
+		}
+		var master bytes.Buffer
+		_, err = io.Copy(&master, obj)
+		obj.Close()
+		if err != nil {
+			return retryableError("could not download master playlist", err)
+		}
+		if err := os.WriteFile(filepath.Join(outputDir, name), []byte(withSubtitles(master.String(), captions)), 0o644); err != nil {
+			return retryableError("could not write master playlist", err)
+		}
+	}
+
+	// Subtitle files go up before the master that references them.
+	prefix := path.Dir(masterKey.String)
+	err = filepath.Walk(filepath.Join(outputDir, subtitlesDir), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, p)
+		if err != nil {
+			return err
+		}
+		if err := w.uploads.acquire(ctx); err != nil {
+			return err
+		}
+		defer w.uploads.release()
+		return w.putFile(ctx, p, path.Join(prefix, filepath.ToSlash(rel)))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return retryableError("could not upload subtitle renditions", err)
+	}
+	for name, key := range playlists {
+		if err := w.putFile(ctx, filepath.Join(outputDir, name), key); err != nil {
+			return retryableError("could not upload master playlist", err)
+		}
+	}
+	log.Printf("💬 Published %d caption tracks for video ID %d", len(captions), job.VideoID)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const clamdChunkSize = 64 << 10
+
+// ErrScanLimitExceeded is returned when the file is larger than clamd's
+// StreamMaxLength setting.
+var ErrScanLimitExceeded = errors.New("clamd: INSTREAM size limit exceeded")
+
+// ClamdScanner talks to a ClamAV clamd daemon over TCP using the INSTREAM
+// command. Any server speaking the same protocol, such as a fake in tests,
+// can be used by pointing Addr at it.
+type ClamdScanner struct {
+	Addr string
+	// Timeout bounds connecting, each chunk sent and waiting for the verdict,
+	// so a large upload can take as long as it needs while data flows.
+	Timeout time.Duration
+}
+
+// ScanResult is the verdict for one stream. Signature is only set when the
+// stream is infected.
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// Scan streams r to clamd and returns its verdict.
+func (c *ClamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	dialer := net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd: failed to connect to %s: %w", c.Addr, err)
+	}
+	defer conn.Close()
+	// extendDeadline gives the next read or write a full Timeout. Once the job
+	// is cancelled the deadline is left in the past.
+	extendDeadline := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if c.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(c.Timeout))
+		}
+		return nil
+	}
+	if err := extendDeadline(); err != nil {
+		return ScanResult{}, err
+	}
+	// Unblock any in-flight read or write if the job is cancelled.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// clamd replies and hangs up as soon as the stream passes its
+	// StreamMaxLength, so a failed send may be explained by that reply.
+	sendFailed := func(what string, err error) (ScanResult, error) {
+		if _, replyErr := readClamdReply(conn); errors.Is(replyErr, ErrScanLimitExceeded) {
+			return ScanResult{}, replyErr
+		}
+		return ScanResult{}, fmt.Errorf("clamd: failed to %s: %w", what, err)
+	}
+
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return sendFailed("send command", err)
+	}
+
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if err := extendDeadline(); err != nil {
+				return ScanResult{}, err
+			}
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := w.Write(size); err != nil {
+				return sendFailed("send chunk", err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return sendFailed("send chunk", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, fmt.Errorf("clamd: failed to read source: %w", readErr)
+		}
+	}
+
+	if err := extendDeadline(); err != nil {
+		return ScanResult{}, err
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := w.Write(size); err != nil {
+		return sendFailed("terminate stream", err)
+	}
+	if err := w.Flush(); err != nil {
+		return sendFailed("send stream", err)
+	}
+	return readClamdReply(conn)
+}
+
+func readClamdReply(conn net.Conn) (ScanResult, error) {
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && !(err == io.EOF && len(reply) > 0) {
+		return ScanResult{}, fmt.Errorf("clamd: failed to read reply: %w", err)
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply understands the three INSTREAM replies:
+// "stream: OK", "stream: <signature> FOUND" and "<message> ERROR".
+func parseClamdReply(reply string) (ScanResult, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		sig := strings.TrimSuffix(reply, " FOUND")
+		sig = strings.TrimPrefix(sig, "stream: ")
+		return ScanResult{Infected: true, Signature: sig}, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return ScanResult{}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return ScanResult{}, ErrScanLimitExceeded
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clamdLimitReply is what clamd sends when a stream passes StreamMaxLength.
+const clamdLimitReply = "INSTREAM size limit exceeded. ERROR"
+
+// fakeClamd accepts an INSTREAM connection, reads the whole stream and answers
+// with reply. The bytes it received are sent on got. Like clamd, once more
+// than maxLength bytes arrive it answers clamdLimitReply and hangs up without
+// reading the rest; zero means no limit.
+func fakeClamd(t *testing.T, reply string, maxLength int) (addr string, got <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		cmd, err := r.ReadString(0)
+		if err != nil || cmd != "zINSTREAM\x00" {
+			conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+		var data bytes.Buffer
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+				return
+			}
+			if maxLength > 0 && data.Len() > maxLength {
+				received <- data.Bytes()
+				conn.Write([]byte(clamdLimitReply + "\x00"))
+				return
+			}
+		}
+		received <- data.Bytes()
+		conn.Write([]byte(reply + "\x00"))
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestClamdScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    ScanResult
+		wantErr error
+	}{
+		{"clean", "stream: OK", ScanResult{}, nil},
+		{"infected", "stream: Eicar-Test-Signature FOUND", ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, got := fakeClamd(t, tt.reply, 0)
+			scanner := &ClamdScanner{Addr: addr, Timeout: 5 * time.Second}
+			source := strings.Repeat("x", clamdChunkSize*2+123)
+			result, err := scanner.Scan(context.Background(), strings.NewReader(source))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Scan() error = %v, want %v", err, tt.wantErr)
+			}
+			if result != tt.want {
+				t.Errorf("Scan() = %+v, want %+v", result, tt.want)
+			}
+			if data := <-got; string(data) != source {
+				t.Errorf("clamd received %d bytes, want %d", len(data), len(source))
+			}
+		})
+	}
+}
+
+func TestClamdScanLimitExceeded(t *testing.T) {
+	addr, got := fakeClamd(t, "stream: OK", clamdChunkSize)
+	scanner := &ClamdScanner{Addr: addr, Timeout: 5 * time.Second}
+	// Far more than the socket buffers hold, so sending fails once clamd
+	// hangs up.
+	source := strings.Repeat("x", 64<<20)
+	_, err := scanner.Scan(context.Background(), strings.NewReader(source))
+	if !errors.Is(err, ErrScanLimitExceeded) {
+		t.Fatalf("Scan() error = %v, want %v", err, ErrScanLimitExceeded)
+	}
+	if data := <-got; len(data) >= len(source) {
+		t.Errorf("clamd read the whole %d byte stream, want it to stop at the limit", len(data))
+	}
+}
+
+func TestClamdScanError(t *testing.T) {
+	addr, _ := fakeClamd(t, "Can't allocate memory ERROR", 0)
+	scanner := &ClamdScanner{Addr: addr, Timeout: 5 * time.Second}
+	_, err := scanner.Scan(context.Background(), strings.NewReader("data"))
+	if err == nil || errors.Is(err, ErrScanLimitExceeded) {
+		t.Fatalf("Scan() error = %v, want an unexpected reply error", err)
+	}
+}
+
+// slowReader returns one chunk per read, pausing before each.
+type slowReader struct {
+	chunks int
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.chunks == 0 {
+		return 0, io.EOF
+	}
+	r.chunks--
+	time.Sleep(r.delay)
+	n := copy(p, bytes.Repeat([]byte("x"), clamdChunkSize))
+	return n, nil
+}
+
+func TestClamdScanTimeoutIsPerChunk(t *testing.T) {
+	addr, _ := fakeClamd(t, "stream: OK", 0)
+	// The whole stream takes several times Timeout, but no single chunk does.
+	scanner := &ClamdScanner{Addr: addr, Timeout: 200 * time.Millisecond}
+	_, err := scanner.Scan(context.Background(), &slowReader{chunks: 6, delay: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Scan() error = %v, want the slow but steady stream to be scanned", err)
+	}
+}
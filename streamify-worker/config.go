@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envString returns the named environment variable, or def when it is unset.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration parses the named environment variable as a time.Duration
+// (e.g. "90s", "5m"), falling back to def when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("⚠️ Invalid %s=%q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// envInt parses the named environment variable as an integer, falling back to
+// def when it is unset or invalid.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("⚠️ Invalid %s=%q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const dlqUsage = "usage: worker dlq list [limit] | worker dlq replay <video_id|all>"
+
+// runDLQCommand lets an operator inspect and replay dead-lettered jobs, e.g.
+// `docker compose exec worker ./worker dlq list`.
+func runDLQCommand(ctx context.Context, q *Queue, db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(dlqUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		limit := int64(50)
+		if len(args) > 1 {
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil || n <= 0 {
+				return errors.New(dlqUsage)
+			}
+			limit = n
+		}
+		letters, err := q.ListDeadLetters(ctx, limit)
+		if err != nil {
+			return fmt.Errorf("failed to list dead letters: %w", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(letters)
+
+	case "replay":
+		if len(args) < 2 {
+			return errors.New(dlqUsage)
+		}
+		videoID := 0
+		if args[1] != "all" {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return errors.New(dlqUsage)
+			}
+			videoID = n
+		}
+		// Reset the status first so the worker does not skip the replayed job.
+		// Caption jobs run against ready videos and leave the status alone.
+		jobs, err := q.ReplayDeadLetters(ctx, videoID, func(job VideoJob) error {
+			if job.Task == TaskCaptions {
+				return nil
+			}
+			_, err := db.Exec(`UPDATE videos SET status = 'processing', status_reason = NULL WHERE id = $1`, job.VideoID)
+			return err
+		})
+		fmt.Printf("Replayed %d job(s)\n", len(jobs))
+		return err
+
+	default:
+		return errors.New(dlqUsage)
+	}
+}
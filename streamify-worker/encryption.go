@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errCMAFEncryption rejects CMAF jobs while encryption is enabled; the
+// backend refuses such uploads, so it only affects jobs queued before.
+var errCMAFEncryption = errors.New("ffmpeg cannot encrypt CMAF segments")
+
+// ContentKeys creates the per-video AES-128 keys used to encrypt HLS
+// segments. Keys are stored sealed with the master key; the backend's content
+// key endpoint unseals them for players holding a playback token.
+type ContentKeys struct {
+	aead cipher.AEAD
+	// KeyBaseURL is the backend's public URL, used for the #EXT-X-KEY URI.
+	KeyBaseURL string
+}
+
+// contentKeysFromEnv returns nil when CONTENT_KEY_MASTER is unset, which
+// leaves output unencrypted.
+func contentKeysFromEnv() (*ContentKeys, error) {
+	encoded := os.Getenv("CONTENT_KEY_MASTER")
+	if encoded == "" {
+		return nil, nil
+	}
+	master, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("CONTENT_KEY_MASTER is not valid base64: %w", err)
+	}
+	if len(master) != 32 {
+		return nil, errors.New("CONTENT_KEY_MASTER must be 32 bytes")
+	}
+	baseURL := os.Getenv("KEY_BASE_URL")
+	if baseURL == "" {
+		return nil, errors.New("KEY_BASE_URL must be set when CONTENT_KEY_MASTER is")
+	}
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &ContentKeys{aead: aead, KeyBaseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+// Create generates a fresh key for a video and stores it sealed, replacing
+// the key of any earlier attempt.
+func (c *ContentKeys) Create(db *sql.DB, videoID int) ([]byte, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The video ID is authenticated so a sealed key only opens for its video.
+	sealed := c.aead.Seal(nonce, nonce, key, []byte(strconv.Itoa(videoID)))
+	_, err := db.Exec(`
+	INSERT INTO video_keys (video_id, encrypted_key) VALUES ($1, $2)
+	ON CONFLICT (video_id) DO UPDATE SET encrypted_key = EXCLUDED.encrypted_key, created_at = NOW()`,
+		videoID, sealed)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKeyInfo writes the key and the key info file ffmpeg's
+// -hls_key_info_file expects into dir, which must not be uploaded.
+func (c *ContentKeys) writeKeyInfo(dir string, videoID int, key []byte) (string, error) {
+	keyPath := filepath.Join(dir, "content.key")
+	if err := os.WriteFile(keyPath, key, 0o600); err != nil {
+		return "", err
+	}
+	uri := fmt.Sprintf("%s/content-keys/%d", c.KeyBaseURL, videoID)
+	infoPath := filepath.Join(dir, "content.keyinfo")
+	if err := os.WriteFile(infoPath, []byte(uri+"\n"+keyPath+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return infoPath, nil
+}
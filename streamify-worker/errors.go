@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// JobError carries what the worker should do when a job fails. Errors that
+// are not JobErrors are treated as retryable.
+type JobError struct {
+	// Status is the terminal video status for permanent failures.
+	Status string
+	// Reason is shown to the video's owner.
+	Reason    string
+	Retryable bool
+	Err       error
+}
+
+func (e *JobError) Error() string {
+	if e.Err == nil {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+// permanentError marks a failure that will not go away on retry, such as a
+// file that is not a video.
+func permanentError(reason string, err error) error {
+	return &JobError{Status: "failed", Reason: reason, Err: err}
+}
+
+// retryableError marks a transient failure, such as a network blip.
+func retryableError(reason string, err error) error {
+	return &JobError{Status: "failed", Reason: reason, Retryable: true, Err: err}
+}
+
+// rejectedError marks a source that was refused on policy grounds.
+func rejectedError(reason string) error {
+	return &JobError{Status: "rejected", Reason: reason}
+}
+
+// classifyError returns the JobError view of err.
+func classifyError(err error) *JobError {
+	var jobErr *JobError
+	if errors.As(err, &jobErr) {
+		return jobErr
+	}
+	return &JobError{Status: "failed", Reason: "processing failed", Retryable: true, Err: err}
+}
+
+// badInputPatterns are ffmpeg and ffprobe messages meaning the source itself
+// cannot be read, so another attempt would fail the same way.
+var badInputPatterns = []string{
+	"invalid data found when processing input",
+	"moov atom not found",
+	"could not find codec parameters",
+	"unsupported codec",
+	"decoder (codec",
+	"does not contain any stream",
+	"no such file or directory",
+}
+
+// resourcePatterns are failures of the machine rather than the source. They
+// win over badInputPatterns, since a full disk can make a good source look
+// truncated.
+var resourcePatterns = []string{
+	"no space left on device",
+	"input/output error",
+	"resource temporarily unavailable",
+	"cannot allocate memory",
+	"too many open files",
+}
+
+// ffmpegError classifies a failed ffmpeg or ffprobe run by what it printed.
+// Only a normal non-zero exit that reports a source ffmpeg cannot read is
+// permanent. A process killed by a signal, typically the OOM killer, a
+// resource failure or an exit without a recognised cause may succeed on
+// another attempt.
+func ffmpegError(reason string, err error, stderr string) error {
+	detail := fmt.Errorf("%w\n%s", err, stderr)
+	output := strings.ToLower(stderr)
+	var exitErr *exec.ExitError
+	switch {
+	case containsAny(output, resourcePatterns):
+		return retryableError(reason, detail)
+	case errors.As(err, &exitErr) && !exitErr.ProcessState.Exited():
+		return retryableError(reason+": process was interrupted", detail)
+	case containsAny(output, badInputPatterns):
+		return permanentError(reason, detail)
+	}
+	return retryableError(reason, detail)
+}
+
+func containsAny(s string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.Contains(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeTool installs a shell script named name on PATH for one test.
+func fakeTool(t *testing.T, name, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// exitError runs a shell script and returns its error.
+func exitError(t *testing.T, script string) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", script).Run()
+	if err == nil {
+		t.Fatalf("%q succeeded", script)
+	}
+	return err
+}
+
+func TestFFmpegErrorClasses(t *testing.T) {
+	exited := exitError(t, "exit 1")
+	killed := exitError(t, "kill -9 $$")
+	tests := []struct {
+		name      string
+		err       error
+		stderr    string
+		retryable bool
+	}{
+		{"invalid data", exited, "clip.mp4: Invalid data found when processing input", false},
+		{"moov atom", exited, "[mov,mp4,m4a,3gp,3g2,mj2 @ 0x1] moov atom not found", false},
+		{"codec parameters", exited, "Could not find codec parameters for stream 0 (Video: none)", false},
+		{"unsupported codec", exited, "Unsupported codec with id 0 for input stream 0", false},
+		{"missing decoder", exited, "Decoder (codec none) not found for input stream #0:0", false},
+		{"no streams", exited, "Output file #0 does not contain any stream", false},
+		{"missing source", exited, "clip.mp4: No such file or directory", false},
+		{"disk full", exited, "segment12.ts: No space left on device", true},
+		{"io error", exited, "av_interleaved_write_frame(): Input/output error", true},
+		{"eagain", exited, "Resource temporarily unavailable", true},
+		{"out of memory", exited, "Cannot allocate memory", true},
+		{"disk full over bad input", exited, "No space left on device\nInvalid data found when processing input", true},
+		{"unrecognised exit", exited, "Conversion failed!", true},
+		{"signal", killed, "", true},
+		{"signal over bad input", killed, "Invalid data found when processing input", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyError(ffmpegError("transcoding failed", tt.err, tt.stderr))
+			if got.Retryable != tt.retryable {
+				t.Errorf("retryable = %v, want %v (%v)", got.Retryable, tt.retryable, got)
+			}
+		})
+	}
+}
+
+func TestFFmpegRunSupervisionIsRetryable(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ProcessLimits
+		cause  error
+	}{
+		{"timeout", ProcessLimits{MinTimeout: 200 * time.Millisecond, MaxTimeout: 200 * time.Millisecond}, errFFmpegTimeout},
+		{"stall", ProcessLimits{MinTimeout: time.Minute, MaxTimeout: time.Minute, StallTimeout: 200 * time.Millisecond}, errFFmpegStalled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeTool(t, "ffmpeg", "sleep 30")
+			tr := &FFmpegTranscoder{ffmpeg: &ffmpegRunner{process: tt.limits, slots: newSemaphore(1)}}
+			err := tr.run(context.Background(), []string{"out.m3u8"}, 0, func(float64) {})
+			if !errors.Is(err, tt.cause) {
+				t.Fatalf("run() error = %v, want %v", err, tt.cause)
+			}
+			if !classifyError(err).Retryable {
+				t.Errorf("run() error = %v, want it retryable", err)
+			}
+		})
+	}
+}
+
+func TestProbeSourceClassifiesErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		retryable bool
+	}{
+		{"bad input", "echo 'moov atom not found' >&2; exit 1", false},
+		{"no video stream", `echo '{"streams": [{"codec_type": "audio"}], "format": {}}'`, false},
+		{"io error", "echo 'Input/output error' >&2; exit 1", true},
+		{"killed", "kill -9 $$", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeTool(t, "ffprobe", tt.script)
+			_, err := probeSource(context.Background(), ProcessLimits{MinTimeout: time.Minute}, "clip.mp4")
+			if err == nil {
+				t.Fatal("probeSource() succeeded")
+			}
+			if got := classifyError(err).Retryable; got != tt.retryable {
+				t.Errorf("retryable = %v, want %v (%v)", got, tt.retryable, err)
+			}
+		})
+	}
+}
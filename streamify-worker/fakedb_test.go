@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeDB is a database/sql driver that records every statement and answers
+// queries from canned rows. Queries without canned rows return no rows, and
+// every exec affects one row.
+type fakeDB struct {
+	mu    sync.Mutex
+	execs []fakeExec
+	rows  map[string][][]driver.Value
+}
+
+type fakeExec struct {
+	Query string
+	Args  []driver.Value
+}
+
+var (
+	fakeDBs     sync.Map
+	fakeDBCount atomic.Int64
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// newFakeDB opens a database backed by a new fakeDB.
+func newFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	t.Helper()
+	f := &fakeDB{rows: map[string][][]driver.Value{}}
+	name := fmt.Sprintf("db%d", fakeDBCount.Add(1))
+	fakeDBs.Store(name, f)
+	db, err := sql.Open("fakedb", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+// setRows makes queries starting with prefix return rows.
+func (f *fakeDB) setRows(prefix string, rows ...[]driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rows[prefix] = rows
+}
+
+// execsLike returns the statements containing substr, in order.
+func (f *fakeDB) execsLike(substr string) []fakeExec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []fakeExec
+	for _, e := range f.execs {
+		if strings.Contains(e.Query, substr) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	f, ok := fakeDBs.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("fakedb: unknown database %q", name)
+	}
+	return &fakeConn{db: f.(*fakeDB)}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: strings.Join(strings.Fields(query), " ")}, nil
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.execs = append(s.db.execs, fakeExec{Query: s.query, Args: args})
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	for prefix, rows := range s.db.rows {
+		if strings.HasPrefix(s.query, prefix) {
+			return &fakeRows{rows: rows}, nil
+		}
+	}
+	return &fakeRows{}, nil
+}
+
+// ExecContext and QueryContext keep database/sql from rejecting the
+// variable argument count.
+func (s *fakeStmt) ExecContext(_ context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.Exec(values(args))
+}
+
+func (s *fakeStmt) QueryContext(_ context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.Query(values(args))
+}
+
+func values(named []driver.NamedValue) []driver.Value {
+	out := make([]driver.Value, len(named))
+	for i, v := range named {
+		out[i] = v.Value
+	}
+	return out
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fakeSourceDuration is the duration FakeTranscoder reports for every source.
+const fakeSourceDuration = 30 * time.Second
+
+// FakeTranscoder writes synthetic playlists, segments and images laid out
+// exactly like ffmpeg's output, without running ffmpeg. It lets the queue,
+// retry, status and upload logic run in development and in tests. The
+// output is deterministic, so a retried job produces identical files.
+// Overlays are ignored.
+type FakeTranscoder struct {
+	// Duration is how long a transcode pretends to take, spread evenly across
+	// its segments.
+	Duration time.Duration
+	// Err, when set, is returned by every Transcode call.
+	Err error
+}
+
+// Probe reports a 720p H.264 source with one stereo AAC track. The input
+// must exist, so a missing upload still fails like it would with ffprobe.
+func (t *FakeTranscoder) Probe(ctx context.Context, inputPath string) (SourceInfo, error) {
+	fi, err := os.Stat(inputPath)
+	if err != nil {
+		return SourceInfo{}, ffmpegError("source is not a readable video", err, err.Error())
+	}
+	src := SourceInfo{
+		Width:         1280,
+		Height:        720,
+		HasAudio:      true,
+		Duration:      fakeSourceDuration,
+		FrameRate:     30,
+		VideoCodec:    "h264",
+		AudioCodec:    "aac",
+		AudioChannels: 2,
+		BitRate:       fi.Size() * 8 / int64(fakeSourceDuration.Seconds()),
+		SizeBytes:     fi.Size(),
+		Container:     "mov,mp4,m4a,3gp,3g2,mj2",
+		AudioTracks:   []AudioTrack{{Codec: "aac", Channels: 2, ChannelLayout: "stereo", Default: true}},
+	}
+	raw, err := json.Marshal(map[string]interface{}{"fake": true, "format": map[string]string{"filename": inputPath}})
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	src.Raw = raw
+	return src, nil
+}
+
+func (t *FakeTranscoder) Transcode(ctx context.Context, spec TranscodeSpec, progress func(percent float64)) (TranscodeOutput, error) {
+	if t.Err != nil {
+		return TranscodeOutput{}, t.Err
+	}
+	duration := spec.Source.Duration
+	if duration <= 0 {
+		duration = fakeSourceDuration
+	}
+	segments := int((duration + hlsSegmentSeconds*time.Second - 1) / (hlsSegmentSeconds * time.Second))
+
+	// Streams are numbered like ffmpeg's outputs: renditions, then audio.
+	var names []string
+	for _, r := range spec.Renditions {
+		names = append(names, r.Name)
+	}
+	for i := range spec.Source.AudioTracks {
+		names = append(names, audioRenditionName(i))
+	}
+
+	var out TranscodeOutput
+	write := func(rel, content string) error {
+		p := filepath.Join(spec.OutputDir, rel)
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			return err
+		}
+		out.Files = append(out.Files, rel)
+		return os.WriteFile(p, []byte(content), 0o644)
+	}
+
+	cmaf := spec.Format == FormatCMAF
+	fmp4 := cmaf || spec.Profile.needsFMP4()
+	total := len(names) * segments
+	for i, name := range names {
+		playlist, initSeg, segName := filepath.Join(name, "playlist.m3u8"), filepath.Join(name, "init.mp4"), name+"/segment%d"
+		if cmaf {
+			playlist, initSeg, segName = fmt.Sprintf("media_%d.m3u8", i), fmt.Sprintf("init-%d.m4s", i), fmt.Sprintf("chunk-%d-%%05d", i)
+		}
+		ext := ".ts"
+		if fmp4 {
+			ext = ".m4s"
+			if err := write(initSeg, "fake init segment "+name+"\n"); err != nil {
+				return out, retryableError("could not write fake output", err)
+			}
+		}
+
+		var m strings.Builder
+		version := 3
+		if fmp4 {
+			version = 7
+		}
+		fmt.Fprintf(&m, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", version, hlsSegmentSeconds)
+		if fmp4 {
+			fmt.Fprintf(&m, "#EXT-X-MAP:URI=%q\n", filepath.Base(initSeg))
+		}
+		for n := 0; n < segments; n++ {
+			seconds := float64(hlsSegmentSeconds)
+			if n == segments-1 {
+				seconds = duration.Seconds() - float64(n*hlsSegmentSeconds)
+			}
+			// The DASH muxer numbers segments from 1.
+			number := n
+			if cmaf {
+				number = n + 1
+			}
+			seg := fmt.Sprintf(segName, number) + ext
+			if err := write(seg, fmt.Sprintf("fake segment %s %d\n", name, n)); err != nil {
+				return out, retryableError("could not write fake output", err)
+			}
+			fmt.Fprintf(&m, "#EXTINF:%.6f,\n%s\n", seconds, filepath.Base(seg))
+
+			if err := t.wait(ctx, total); err != nil {
+				return out, err
+			}
+			progress(float64(i*segments+n+1) / float64(total) * 100)
+		}
+		m.WriteString("#EXT-X-ENDLIST\n")
+		if err := write(playlist, m.String()); err != nil {
+			return out, retryableError("could not write fake output", err)
+		}
+	}
+
+	if cmaf {
+		mpd := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT%.3fS" minBufferTime="PT%dS" profiles="urn:mpeg:dash:profile:isoff-live:2011">
+</MPD>
+`, duration.Seconds(), hlsSegmentSeconds)
+		if err := write(dashManifestName, mpd); err != nil {
+			return out, retryableError("could not write fake output", err)
+		}
+	}
+	return out, nil
+}
+
+// wait spends one segment's share of Duration.
+func (t *FakeTranscoder) wait(ctx context.Context, segments int) error {
+	if t.Duration <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-time.After(t.Duration / time.Duration(segments)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Images writes a plain grey poster and thumbnails; the fake source has no
+// frames for a storyboard.
+func (t *FakeTranscoder) Images(ctx context.Context, inputPath, outputDir string, src SourceInfo, overlay Overlay) (VideoImages, error) {
+	dir := filepath.Join(outputDir, imagesDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return VideoImages{}, err
+	}
+	images := VideoImages{Thumbnails: map[string]string{}}
+	if err := writeFakeJPEG(filepath.Join(dir, "poster.jpg"), src.Width, src.Height); err != nil {
+		return images, err
+	}
+	images.Poster = storageKey(imagesDir, "poster.jpg")
+	for _, width := range thumbnailWidths {
+		if width > src.Width && width != thumbnailWidths[len(thumbnailWidths)-1] {
+			continue
+		}
+		name := fmt.Sprintf("thumb_%d.jpg", width)
+		height := width * 9 / 16
+		if src.Width > 0 {
+			height = evenDimension(src.Height * width / src.Width)
+		}
+		if err := writeFakeJPEG(filepath.Join(dir, name), width, height); err != nil {
+			return images, err
+		}
+		images.Thumbnails[strconv.Itoa(width)] = storageKey(imagesDir, name)
+	}
+	return images, nil
+}
+
+func writeFakeJPEG(path string, width, height int) error {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{Y: 128}), image.Point{}, draw.Src)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, img, nil); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
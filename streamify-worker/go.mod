@@ -3,6 +3,7 @@ module streamify-worker
 go 1.24.4
 
 require (
+	github.com/alicebob/miniredis/v2 v2.35.0
 	github.com/aws/aws-sdk-go v1.55.8
 	github.com/lib/pq v1.10.9
 	github.com/redis/go-redis/v9 v9.12.1
@@ -12,4 +13,5 @@ require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	imagesDir       = "images"
+	spriteTileW     = 160
+	spriteTileH     = 90
+	spriteColumns   = 10
+	spriteMaxTiles  = 100
+	spriteMinPeriod = 2 * time.Second
+)
+
+// thumbnailWidths are the sizes generated from the poster frame; sizes wider
+// than the source are skipped.
+var thumbnailWidths = []int{1280, 640, 320}
+
+// VideoImages lists the image artifacts of a job, relative to its output
+// directory (and therefore to its storage prefix).
+type VideoImages struct {
+	Poster     string
+	Thumbnails map[string]string
+	Sprite     string
+	Storyboard string
+}
+
+// generateImages writes a poster, thumbnails and a storyboard sprite with its
+// WebVTT index into outputDir/images. The storyboard decodes the whole
+// source, so the pass holds an ffmpeg slot like a transcode does. The images
+// are shared by the clean and preview playlists, so the overlay is drawn on
+// them too; otherwise a review copy's poster and storyboard would show clean
+// frames.
+func generateImages(ctx context.Context, ffmpeg *ffmpegRunner, inputPath, outputDir string, src SourceInfo, overlay Overlay) (VideoImages, error) {
+	if err := ffmpeg.slots.acquire(ctx); err != nil {
+		return VideoImages{}, err
+	}
+	defer ffmpeg.slots.release()
+
+	dir := filepath.Join(outputDir, imagesDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return VideoImages{}, err
+	}
+	images := VideoImages{Thumbnails: map[string]string{}}
+
+	offset := posterOffset(ctx, ffmpeg, inputPath, src.Duration)
+	poster := filepath.Join(dir, "poster.jpg")
+	// The thumbnail filter picks the most representative frame of a short
+	// window, which avoids fades and motion blur at the exact offset.
+	args := append([]string{"-y", "-ss", formatSeconds(offset), "-i", inputPath}, overlay.filterArgs(src.Width, "thumbnail=30")...)
+	err := ffmpeg.quiet(ctx, src.Duration, append(args, "-frames:v", "1", "-q:v", "2", poster)...)
+	if err != nil {
+		return images, fmt.Errorf("failed to extract poster: %w", err)
+	}
+	images.Poster = storageKey(imagesDir, "poster.jpg")
+
+	for _, width := range thumbnailWidths {
+		if width > src.Width && width != thumbnailWidths[len(thumbnailWidths)-1] {
+			continue
+		}
+		name := fmt.Sprintf("thumb_%d.jpg", width)
+		err := ffmpeg.quiet(ctx, src.Duration, "-y", "-i", poster,
+			"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", width), "-q:v", "3", filepath.Join(dir, name))
+		if err != nil {
+			return images, fmt.Errorf("failed to create %s: %w", name, err)
+		}
+		images.Thumbnails[strconv.Itoa(width)] = storageKey(imagesDir, name)
+	}
+
+	if src.Duration > 0 {
+		if err := generateStoryboard(ctx, ffmpeg, inputPath, dir, src, overlay); err != nil {
+			return images, err
+		}
+		images.Sprite = storageKey(imagesDir, "sprite.jpg")
+		images.Storyboard = storageKey(imagesDir, "storyboard.vtt")
+	}
+	return images, nil
+}
+
+// generateStoryboard renders evenly spaced frames into one sprite sheet and
+// writes a WebVTT file mapping each time range to its tile, the format
+// players use for scrubbing previews.
+func generateStoryboard(ctx context.Context, ffmpeg *ffmpegRunner, inputPath, dir string, src SourceInfo, overlay Overlay) error {
+	duration := src.Duration
+	period := duration / spriteMaxTiles
+	if period < spriteMinPeriod {
+		period = spriteMinPeriod
+	}
+	tiles := int(math.Ceil(duration.Seconds() / period.Seconds()))
+	if tiles < 1 {
+		tiles = 1
+	}
+	rows := (tiles + spriteColumns - 1) / spriteColumns
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		formatSeconds(period), spriteTileW, spriteTileH, spriteTileW, spriteTileH, spriteColumns, rows)
+	args := append([]string{"-y", "-i", inputPath}, overlay.filterArgs(src.Width, filter)...)
+	err := ffmpeg.quiet(ctx, duration, append(args, "-frames:v", "1", "-q:v", "4", filepath.Join(dir, "sprite.jpg"))...)
+	if err != nil {
+		return fmt.Errorf("failed to create storyboard sprite: %w", err)
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i := 0; i < tiles; i++ {
+		start := time.Duration(i) * period
+		end := start + period
+		if end > duration {
+			end = duration
+		}
+		x := (i % spriteColumns) * spriteTileW
+		y := (i / spriteColumns) * spriteTileH
+		fmt.Fprintf(&vtt, "\n%s --> %s\nsprite.jpg#xywh=%d,%d,%d,%d\n", vttTimestamp(start), vttTimestamp(end), x, y, spriteTileW, spriteTileH)
+	}
+	return os.WriteFile(filepath.Join(dir, "storyboard.vtt"), []byte(vtt.String()), 0o644)
+}
+
+var blackEndPattern = regexp.MustCompile(`black_start:([\d.]+) black_end:([\d.]+)`)
+
+// posterOffset picks a point about 10% into the video (at most 10 seconds in)
+// and, if it lands in a black section such as a fade-in or slate, moves it
+// just past the end of that section.
+func posterOffset(ctx context.Context, ffmpeg *ffmpegRunner, inputPath string, duration time.Duration) time.Duration {
+	offset := duration / 10
+	if offset > 10*time.Second {
+		offset = 10 * time.Second
+	}
+	if duration <= 0 {
+		return 0
+	}
+
+	window := 2 * time.Minute
+	if window > duration {
+		window = duration
+	}
+	ctx, cancel := context.WithTimeout(ctx, ffmpeg.process.timeoutFor(window))
+	defer cancel()
+	cmd := ffmpeg.process.command(ctx, "ffmpeg", []string{"-t", formatSeconds(window), "-i", inputPath,
+		"-vf", "blackdetect=d=0.1:pix_th=0.10", "-an", "-f", "null", "-"})
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return offset
+	}
+
+	for _, m := range blackEndPattern.FindAllStringSubmatch(stderr.String(), -1) {
+		start, _ := strconv.ParseFloat(m[1], 64)
+		end, _ := strconv.ParseFloat(m[2], 64)
+		if offset.Seconds() >= start && offset.Seconds() <= end {
+			candidate := time.Duration((end + 0.5) * float64(time.Second))
+			if candidate < duration {
+				offset = candidate
+			}
+		}
+	}
+	return offset
+}
+
+// saveVideoImages records the storage keys of a video's images.
+func saveVideoImages(db *sql.DB, videoID int, keyPrefix string, images VideoImages) error {
+	key := func(rel string) interface{} {
+		if rel == "" {
+			return nil
+		}
+		return storageKey(keyPrefix, rel)
+	}
+	thumbs := make(map[string]string, len(images.Thumbnails))
+	for size, rel := range images.Thumbnails {
+		thumbs[size] = storageKey(keyPrefix, rel)
+	}
+	thumbsJSON, err := json.Marshal(thumbs)
+	if err != nil {
+		return err
+	}
+	query := `
+	UPDATE videos SET poster_key = $1, thumbnail_keys = $2, sprite_key = $3, storyboard_key = $4
+	WHERE id = $5`
+	_, err = db.Exec(query, key(images.Poster), thumbsJSON, key(images.Sprite), key(images.Storyboard), videoID)
+	return err
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// storageKey joins storage key segments with forward slashes.
+func storageKey(elem ...string) string {
+	return strings.Join(elem, "/")
+}
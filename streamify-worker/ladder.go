@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	masterPlaylistName = "master.m3u8"
+	// previewPlaylistName lists the watermarked preview renditions.
+	previewPlaylistName = "preview.m3u8"
+	audioGroupID        = "audio"
+	hlsSegmentSeconds   = 6
+	// compatibilityMaxHeight caps the H.264 renditions added alongside a
+	// newer codec; they are a fallback, not the best available quality.
+	compatibilityMaxHeight = 720
+)
+
+// Rendition is one rung of the adaptive bitrate ladder.
+type Rendition struct {
+	Name   string
+	Codec  string
+	Width  int
+	Height int
+	// MaxRateKbps caps the CRF encode and is advertised as BANDWIDTH.
+	MaxRateKbps int
+	BufSizeKbps int
+	// Level is the level_idc, e.g. 31 for level 3.1. VP9 numbers its levels
+	// the same way; HEVC and AV1 levels are derived from it.
+	Level int
+	// Watermarked renditions are preview copies with the job's overlay
+	// burned in. They are listed in the preview playlist, not the master.
+	Watermarked bool
+}
+
+// defaultLadder holds the H.264 bitrates; other codecs scale them down.
+var defaultLadder = []Rendition{
+	{Name: "1080p", Height: 1080, MaxRateKbps: 5000, BufSizeKbps: 10000, Level: 40},
+	{Name: "720p", Height: 720, MaxRateKbps: 2800, BufSizeKbps: 5600, Level: 31},
+	{Name: "480p", Height: 480, MaxRateKbps: 1400, BufSizeKbps: 2800, Level: 30},
+	{Name: "360p", Height: 360, MaxRateKbps: 800, BufSizeKbps: 1600, Level: 30},
+}
+
+// buildLadder returns the renditions to encode for a source. Profiles using a
+// codec other than H.264 also get H.264 renditions up to 720p so that every
+// player has something it can decode.
+func buildLadder(src SourceInfo, profile EncodingProfile) []Rendition {
+	renditions := selectRenditions(defaultLadder, src)
+	scale := bitrateScale[profile.Codec]
+	for i := range renditions {
+		renditions[i].Codec = profile.Codec
+		if scale > 0 {
+			renditions[i].MaxRateKbps = int(float64(renditions[i].MaxRateKbps) * scale)
+			renditions[i].BufSizeKbps = int(float64(renditions[i].BufSizeKbps) * scale)
+		}
+	}
+	if profile.Codec == CodecH264 {
+		return renditions
+	}
+
+	var compat []Rendition
+	for _, r := range defaultLadder {
+		if r.Height <= compatibilityMaxHeight {
+			compat = append(compat, r)
+		}
+	}
+	for _, r := range selectRenditions(compat, src) {
+		r.Codec = CodecH264
+		r.Name += "_h264"
+		renditions = append(renditions, r)
+	}
+	return renditions
+}
+
+// previewLadder returns watermarked copies of the renditions named in names,
+// or of every rendition when names is empty. If none of the named rungs fits
+// the source, the smallest rendition is copied so a preview still exists.
+func previewLadder(renditions []Rendition, names []string) []Rendition {
+	wanted := make(map[string]bool, len(names))
+	for _, n := range names {
+		wanted[n] = true
+	}
+	var out []Rendition
+	for _, r := range renditions {
+		if len(names) == 0 || wanted[r.Name] {
+			out = append(out, previewRendition(r))
+		}
+	}
+	if len(out) == 0 && len(renditions) > 0 {
+		out = append(out, previewRendition(renditions[len(renditions)-1]))
+	}
+	return out
+}
+
+func previewRendition(r Rendition) Rendition {
+	r.Name += "_wm"
+	r.Watermarked = true
+	return r
+}
+
+// renditionProfile returns the encoder settings for a rendition: the job's
+// profile, or the compatibility profile for fallback H.264 renditions.
+func renditionProfile(r Rendition, profile EncodingProfile) EncodingProfile {
+	if r.Codec == profile.Codec {
+		return profile
+	}
+	return compatibilityProfile(profile)
+}
+
+// selectRenditions picks the rungs that do not upscale the source and sizes
+// them to the source's aspect ratio. A source smaller than the lowest rung is
+// encoded once at its own resolution.
+func selectRenditions(ladder []Rendition, src SourceInfo) []Rendition {
+	var out []Rendition
+	for _, r := range ladder {
+		if r.Height > src.Height {
+			continue
+		}
+		r.Width = evenDimension(src.Width * r.Height / src.Height)
+		out = append(out, r)
+	}
+	if len(out) == 0 {
+		r := ladder[len(ladder)-1]
+		r.Height = evenDimension(src.Height)
+		r.Width = evenDimension(src.Width)
+		r.Name = fmt.Sprintf("%dp", r.Height)
+		out = append(out, r)
+	}
+	return out
+}
+
+func evenDimension(n int) int {
+	if n < 2 {
+		return 2
+	}
+	return n &^ 1
+}
+
+// Output formats selectable per job.
+const (
+	// FormatHLS produces HLS with MPEG-TS segments.
+	FormatHLS = "hls"
+	// FormatCMAF produces fragmented-MP4 (CMAF) segments referenced by both an
+	// HLS master playlist and a DASH manifest.
+	FormatCMAF = "cmaf"
+
+	dashManifestName = "manifest.mpd"
+)
+
+// ladderArgs builds a single ffmpeg invocation that encodes every rendition.
+// Each audio track is encoded once as a separate rendition shared by all
+// variants. For HLS each rendition gets its own media playlist under
+// outputDir/<name>/, with MPEG-TS segments unless the profile's codecs need
+// fMP4; for CMAF the DASH muxer writes one set of fMP4 segments plus a DASH
+// manifest and an HLS media playlist per stream. A non-empty keyInfoFile
+// encrypts HLS segments with AES-128. The source is split into a clean copy
+// and, when there are watermarked renditions, a copy with the overlay drawn
+// on before it is scaled, so the overlay sits in the same place in every
+// watermarked rendition and never reaches the clean ones.
+func ladderArgs(inputPath, outputDir string, renditions []Rendition, profile EncodingProfile, src SourceInfo, format, keyInfoFile string, overlay Overlay) []string {
+	hasAudio := len(src.AudioTracks) > 0
+	args := []string{"-i", inputPath}
+
+	var clean, marked []int
+	for i, r := range renditions {
+		if r.Watermarked {
+			marked = append(marked, i)
+		} else {
+			clean = append(clean, i)
+		}
+	}
+	var filter strings.Builder
+	split := func(video string, streams []int) {
+		fmt.Fprintf(&filter, "%ssplit=%d", video, len(streams))
+		for _, i := range streams {
+			fmt.Fprintf(&filter, "[v%d]", i)
+		}
+	}
+	if len(marked) > 0 {
+		if overlay.ImagePath != "" {
+			args = append(args, "-i", overlay.ImagePath)
+		}
+		filter.WriteString("[0:v]split=2[clean][unmarked];" + overlay.filter(src.Width, "[unmarked]", "[marked]") + ";")
+		split("[clean]", clean)
+		filter.WriteString(";")
+		split("[marked]", marked)
+	} else {
+		split("[0:v]", clean)
+	}
+	for i, r := range renditions {
+		fmt.Fprintf(&filter, ";[v%d]scale=w=%d:h=%d[v%dout]", i, r.Width, r.Height, i)
+	}
+	args = append(args, "-filter_complex", filter.String())
+
+	var streamMap []string
+	for i, r := range renditions {
+		n := strconv.Itoa(i)
+		args = append(args, "-map", "[v"+n+"out]")
+		args = append(args, videoEncoderArgs(i, r, renditionProfile(r, profile), src.FrameRate)...)
+		entry := "v:" + n + ",name:" + r.Name
+		if hasAudio {
+			entry += ",agroup:" + audioGroupID
+		}
+		streamMap = append(streamMap, entry)
+	}
+	// Aligned keyframes at every segment boundary let players switch cleanly.
+	args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", profile.GOPSeconds))
+
+	for i, track := range src.AudioTracks {
+		args = append(args, "-map", fmt.Sprintf("0:a:%d", i))
+		args = append(args, audioEncoderArgs(i, track, profile)...)
+		streamMap = append(streamMap, fmt.Sprintf("a:%d,name:%s,agroup:%s", i, audioRenditionName(i), audioGroupID))
+	}
+
+	if format == FormatCMAF {
+		// Each codec needs its own adaptation set; players pick one they support.
+		var sets []string
+		var codecs []string
+		streams := map[string][]string{}
+		for i, r := range renditions {
+			if streams[r.Codec] == nil {
+				codecs = append(codecs, r.Codec)
+			}
+			streams[r.Codec] = append(streams[r.Codec], strconv.Itoa(i))
+		}
+		for i, codec := range codecs {
+			sets = append(sets, fmt.Sprintf("id=%d,streams=%s", i, strings.Join(streams[codec], ",")))
+		}
+		// Languages get separate adaptation sets so DASH players can choose.
+		for i := range src.AudioTracks {
+			sets = append(sets, fmt.Sprintf("id=%d,streams=%d", len(codecs)+i, len(renditions)+i))
+		}
+		adaptationSets := strings.Join(sets, " ")
+		return append(args,
+			"-f", "dash",
+			"-seg_duration", strconv.Itoa(hlsSegmentSeconds),
+			"-use_template", "1",
+			"-use_timeline", "1",
+			"-hls_playlist", "1",
+			"-init_seg_name", "init-$RepresentationID$.m4s",
+			"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+			"-adaptation_sets", adaptationSets,
+			filepath.Join(outputDir, dashManifestName),
+		)
+	}
+
+	segmentName := "segment%d.ts"
+	if profile.needsFMP4() {
+		segmentName = "segment%d.m4s"
+		args = append(args, "-hls_segment_type", "fmp4")
+	}
+	if keyInfoFile != "" {
+		args = append(args, "-hls_key_info_file", keyInfoFile)
+	}
+	return append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_list_size", "0",
+		"-start_number", "0",
+		"-hls_segment_filename", filepath.Join(outputDir, "%v", segmentName),
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outputDir, "%v", "playlist.m3u8"),
+	)
+}
+
+// mediaPlaylistURI is the path of a stream's media playlist relative to the
+// master. The DASH muxer names its HLS playlists after the output stream index.
+func mediaPlaylistURI(format string, index int, name string) string {
+	if format == FormatCMAF {
+		return fmt.Sprintf("media_%d.m3u8", index)
+	}
+	return name + "/playlist.m3u8"
+}
+
+func audioRenditionName(track int) string {
+	return fmt.Sprintf("audio_%d", track)
+}
+
+// defaultAudioTrack is the track players fall back to when none matches the
+// viewer's language: the source's default track, or else the first.
+func defaultAudioTrack(tracks []AudioTrack) int {
+	for i, t := range tracks {
+		if t.Default {
+			return i
+		}
+	}
+	return 0
+}
+
+// audioTrackNames returns the NAME of each audio rendition, which must be
+// unique within the group.
+func audioTrackNames(tracks []AudioTrack) []string {
+	names := make([]string, len(tracks))
+	seen := map[string]int{}
+	for i, t := range tracks {
+		name := t.Title
+		if name == "" {
+			name = t.Language
+		}
+		if name == "" {
+			name = fmt.Sprintf("Track %d", i+1)
+		}
+		name = quotedAttr(name)
+		seen[name]++
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%s (%d)", name, seen[name])
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// writeMasterPlaylist writes the HLS master playlist referencing each clean
+// rendition's media playlist, with the attributes players use to choose one.
+// Audio tracks form one EXT-X-MEDIA group, and an audio-only variant carrying
+// the default track is listed last for low-bandwidth listeners. It replaces
+// the master the DASH muxer writes for CMAF output. Watermarked renditions
+// get a playlist of their own, laid out the same way.
+func writeMasterPlaylist(outputDir string, renditions []Rendition, profile EncodingProfile, tracks []AudioTrack, format string) error {
+	if err := writeVariantPlaylist(filepath.Join(outputDir, masterPlaylistName), renditions, false, profile, tracks, format); err != nil {
+		return err
+	}
+	for _, r := range renditions {
+		if r.Watermarked {
+			return writeVariantPlaylist(filepath.Join(outputDir, previewPlaylistName), renditions, true, profile, tracks, format)
+		}
+	}
+	return nil
+}
+
+// writeVariantPlaylist writes a master playlist at path listing the
+// renditions that are watermarked, or those that are not.
+func writeVariantPlaylist(path string, renditions []Rendition, watermarked bool, profile EncodingProfile, tracks []AudioTrack, format string) error {
+	hasAudio := len(tracks) > 0
+	var b strings.Builder
+	version := 3
+	if format == FormatCMAF || profile.needsFMP4() {
+		// EXT-X-MAP for fMP4 initialization segments needs version 7.
+		version = 7
+	}
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", version)
+
+	codecs := ""
+	defaultTrack := defaultAudioTrack(tracks)
+	for i, name := range audioTrackNames(tracks) {
+		isDefault := "NO"
+		if i == defaultTrack {
+			isDefault = "YES"
+		}
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\"", audioGroupID, name)
+		if tracks[i].Language != "" {
+			fmt.Fprintf(&b, ",LANGUAGE=\"%s\"", tracks[i].Language)
+		}
+		fmt.Fprintf(&b, ",DEFAULT=%s,AUTOSELECT=YES,CHANNELS=\"%d\",URI=\"%s\"\n", isDefault,
+			outputChannels(tracks[i], profile), mediaPlaylistURI(format, len(renditions)+i, audioRenditionName(i)))
+		codecs = ",mp4a.40.2"
+	}
+
+	for i, r := range renditions {
+		if r.Watermarked != watermarked {
+			continue
+		}
+		bandwidth := r.MaxRateKbps * 1000
+		if hasAudio {
+			bandwidth += profile.AudioBitrateKbps * 1000
+		}
+		codec := videoCodecString(r, renditionProfile(r, profile))
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s%s\"", bandwidth, r.Width, r.Height, codec, codecs)
+		if hasAudio {
+			fmt.Fprintf(&b, ",AUDIO=\"%s\"", audioGroupID)
+		}
+		fmt.Fprintf(&b, "\n%s\n", mediaPlaylistURI(format, i, r.Name))
+	}
+
+	if hasAudio {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"mp4a.40.2\",AUDIO=\"%s\"\n%s\n",
+			profile.AudioBitrateKbps*1000, audioGroupID, mediaPlaylistURI(format, len(renditions)+defaultTrack, audioRenditionName(defaultTrack)))
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
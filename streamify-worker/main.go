@@ -1,20 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	_ "github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 )
@@ -22,6 +17,27 @@ import (
 type VideoJob struct {
 	Filename string `json:"filename"`
 	VideoID  int    `json:"video_id"`
+	Profile  string `json:"profile"`
+	// OutputFormat is "hls" (the default) or "cmaf".
+	OutputFormat string `json:"output_format,omitempty"`
+	// Task is empty for transcodes and TaskCaptions for caption publishing.
+	Task string `json:"task,omitempty"`
+	// SourceURL is set for imported videos that have not been uploaded yet.
+	SourceURL string `json:"source_url,omitempty"`
+	// UserID and Priority ("high", "normal" or "low") drive scheduling.
+	UserID   int    `json:"user_id,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	// Watermark burns in the owner's organization's watermark image and
+	// WatermarkText a drifting text overlay. Both go into preview copies of
+	// the WatermarkRenditions, or of every rendition when it is empty.
+	Watermark           bool     `json:"watermark,omitempty"`
+	WatermarkText       string   `json:"watermark_text,omitempty"`
+	WatermarkRenditions []string `json:"watermark_renditions,omitempty"`
+	// LockWaits counts how often a captions job found the video locked.
+	LockWaits int `json:"lock_waits,omitempty"`
+	// Attempt counts previous failed attempts; LastError describes the latest.
+	Attempt   int    `json:"attempt,omitempty"`
+	LastError string `json:"last_error,omitempty"`
 }
 
 func main() {
@@ -44,114 +60,127 @@ func main() {
 	}
 	log.Println("✅ Worker connected to PostgreSQL")
 
-	sess, err := createAWSSession()
+	store, err := storageFromEnv()
 	if err != nil {
-		log.Fatal("Worker failed to create AWS session:", err)
-	}
-	uploader := s3manager.NewUploader(sess)
-	bucketName := os.Getenv("S3_BUCKET_NAME")
-	log.Println("✅ Worker AWS session created")
-	log.Println("👷 Worker started. Waiting for jobs...")
-
-	for {
-		result, err := rdb.BRPop(ctx, 0*time.Second, "video_jobs").Result()
-		if err != nil {
-			log.Printf("❌ Failed to pop job from redis: %v", err)
-			continue
-		}
-
-		var job VideoJob
-		if err := json.Unmarshal([]byte(result[1]), &job); err != nil {
-			log.Printf("❌ Failed to parse job JSON: %v", err)
-			continue
-		}
+		log.Fatal("Worker failed to configure storage:", err)
+	}
+	log.Println("✅ Worker storage configured")
+
+	limits := limitsFromEnv()
+	w := &Worker{
+		db:      db,
+		rdb:     rdb,
+		queue:   NewQueue(rdb),
+		retry:   retryPolicyFromEnv(),
+		limits:  limits,
+		uploads: newSemaphore(limits.S3Uploads),
+		storage: store,
+		cancels: newCancellations(),
+		upload:  uploadPolicyFromEnv(),
+		ffmpeg:  &ffmpegRunner{process: processLimitsFromEnv(), slots: newSemaphore(limits.FFmpeg)},
+	}
+	if w.transcoder, err = transcoderFromEnv(w.ffmpeg); err != nil {
+		log.Fatal("Worker failed to configure transcoder:", err)
+	}
+	if _, fake := w.transcoder.(*FakeTranscoder); fake {
+		log.Println("🧪 Using the fake transcoder; output is synthetic")
+	}
+	if addr := os.Getenv("CLAMD_ADDR"); addr != "" {
+		w.scanner = &ClamdScanner{Addr: addr, Timeout: envDuration("CLAMD_TIMEOUT", 5*time.Minute)}
+		log.Printf("🛡️ Malware scanning enabled via clamd at %s", addr)
+	}
+	if w.contentKeys, err = contentKeysFromEnv(); err != nil {
+		log.Fatal("Worker failed to load content key settings:", err)
+	}
+	if w.contentKeys != nil {
+		log.Println("🔐 HLS encryption enabled")
+	}
 
-		log.Printf("📥 Received job for video ID %d: %s", job.VideoID, job.Filename)
-
-		inputPath := filepath.Join("/app/uploads", job.Filename)
-		s3KeyPrefix := fmt.Sprintf("videos/%d/%s", job.VideoID, job.Filename)
-		outputDir := filepath.Join("/tmp", job.Filename)
-		os.MkdirAll(outputDir, os.ModePerm)
-
-		cmd := exec.Command("ffmpeg",
-			"-i", inputPath, "-profile:v", "main", "-level", "3.1",
-			"-start_number", "0", "-hls_time", "10", "-hls_list_size", "0",
-			"-f", "hls", filepath.Join(outputDir, "playlist.m3u8"),
-		)
-
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		if err := cmd.Run(); err != nil {
-			log.Printf("❌ FFmpeg failed for %s: %v\n%s", job.Filename, err, stderr.String())
-			updateVideoStatus(db, job.VideoID, "failed", "") 
-			os.Remove(inputPath)
-			os.RemoveAll(outputDir)
-			continue
+	if len(os.Args) > 1 && os.Args[1] == "queue" {
+		if err := runQueueCommand(ctx, w.queue, os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
-		log.Printf("🎬 Video processed: %s", job.Filename)
-
-		err = filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				s3Key := filepath.Join(s3KeyPrefix, info.Name())
-				err := uploadToS3(uploader, bucketName, path, s3Key)
-				if err != nil {
-					log.Printf("❌ Failed to upload %s to S3: %v", info.Name(), err)
-					return err
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			log.Printf("❌ Error during S3 upload walk: %v", err)
-			updateVideoStatus(db, job.VideoID, "failed", "")
-			os.Remove(inputPath)
-			os.RemoveAll(outputDir)
-			continue
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		if err := runDLQCommand(ctx, w.queue, db, os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
-		log.Printf("☁️ Uploaded all files for %s to S3", job.Filename)
+		return
+	}
 
-		playlistS3Key := filepath.Join(s3KeyPrefix, "playlist.m3u8")
-		err = updateVideoStatus(db, job.VideoID, "ready", playlistS3Key)
-		if err != nil {
-			log.Printf("❌ Failed to update DB for %s: %v", job.Filename, err)
-			continue
-		}
-		log.Printf("✅ Metadata updated in DB for: %s", job.Filename)
+	w.scratchDir, err = os.MkdirTemp("", "streamify-worker-*")
+	if err != nil {
+		log.Fatal("Worker failed to create scratch directory:", err)
+	}
+	defer os.RemoveAll(w.scratchDir)
 
-		os.Remove(inputPath)
-		os.RemoveAll(outputDir)
+	if err := w.queue.Register(ctx); err != nil {
+		log.Fatal("Worker failed to register with the queue:", err)
 	}
-}
+	queueCtx, stopQueue := context.WithCancel(ctx)
+	go w.queue.Run(queueCtx)
+	go w.watchCancellations(queueCtx)
+	log.Printf("👷 Worker %s started with %d job slots (%d ffmpeg, %d S3 uploads). Waiting for jobs...",
+		w.queue.WorkerID(), w.limits.Jobs, w.limits.FFmpeg, w.limits.S3Uploads)
+
+	// SIGTERM or SIGINT stops new jobs from being pulled. In-flight jobs get a
+	// grace period to finish before they are cancelled and put back on the queue.
+	stopCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	jobCtx, cancelJobs := context.WithCancel(ctx)
+	defer cancelJobs()
+	grace := envDuration("WORKER_SHUTDOWN_GRACE", 2*time.Minute)
+	go func() {
+		<-stopCtx.Done()
+		log.Printf("🛑 Shutdown requested, waiting up to %s for in-flight jobs", grace)
+		select {
+		case <-time.After(grace):
+			log.Println("⏱️ Grace period elapsed, cancelling in-flight jobs")
+			cancelJobs()
+		case <-jobCtx.Done():
+		}
+	}()
+
+	w.runPool(stopCtx, jobCtx)
 
-func createAWSSession() (*session.Session, error) {
-	awsRegion := os.Getenv("AWS_REGION")
-	if awsRegion == "" {
-		return nil, fmt.Errorf("AWS_REGION environment variable not set")
+	stopQueue()
+	if err := w.queue.Deregister(ctx); err != nil {
+		log.Printf("❌ Failed to deregister worker: %v", err)
 	}
-	return session.NewSession(&aws.Config{
-		Region: aws.String(awsRegion),
-	})
+	log.Println("👋 Worker stopped")
 }
 
-func uploadToS3(uploader *s3manager.Uploader, bucketName string, filePath string, key string) error {
-	file, err := os.Open(filePath)
+// markVideoReady publishes a processed video. dashKey is empty unless the job
+// produced a DASH manifest, and previewKey unless it was watermarked. It
+// returns errVideoDeleted if the row is gone.
+func markVideoReady(db *sql.DB, videoID int, hlsKey, dashKey, previewKey string) error {
+	query := `
+	UPDATE videos SET status = 'ready', s3_key = $1, dash_key = NULLIF($2, ''), preview_key = NULLIF($3, '')
+	WHERE id = $4`
+	res, err := db.Exec(query, hlsKey, dashKey, previewKey, videoID)
 	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errVideoDeleted
 	}
-	defer file.Close()
+	return nil
+}
 
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
-		Body:   file,
-	})
+// setVideoStatusReason records a terminal status together with a
+// human-readable explanation for the owner.
+func setVideoStatusReason(db *sql.DB, videoID int, status, reason string) error {
+	query := `UPDATE videos SET status = $1, status_reason = $2 WHERE id = $3`
+	_, err := db.Exec(query, status, reason, videoID)
 	return err
 }
-func updateVideoStatus(db *sql.DB, videoID int, status string, s3Key string) error {
-	query := `UPDATE videos SET status = $1, s3_key = $2 WHERE id = $3`
-	_, err := db.Exec(query, status, s3Key, videoID)
+
+// notifyOwner stores a notification for the user who owns the video.
+func notifyOwner(db *sql.DB, videoID int, kind, message string) error {
+	query := `
+	INSERT INTO notifications (user_id, video_id, kind, message)
+	SELECT user_id, id, $2, $3 FROM videos WHERE id = $1`
+	_, err := db.Exec(query, videoID, kind, message)
 	return err
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Limits bounds how much work a single worker process does at once. Jobs
+// spend much of their time downloading, scanning and probing, so the number
+// of concurrent jobs can exceed the number of ffmpeg processes.
+type Limits struct {
+	Jobs      int
+	FFmpeg    int
+	S3Uploads int
+}
+
+func limitsFromEnv() Limits {
+	jobs := envInt("WORKER_CONCURRENCY", 2)
+	if jobs < 1 {
+		jobs = 1
+	}
+	l := Limits{
+		Jobs:      jobs,
+		FFmpeg:    envInt("WORKER_MAX_FFMPEG", jobs),
+		S3Uploads: envInt("WORKER_MAX_S3_UPLOADS", 4),
+	}
+	if l.FFmpeg < 1 {
+		l.FFmpeg = 1
+	}
+	if l.S3Uploads < 1 {
+		l.S3Uploads = 1
+	}
+	return l
+}
+
+// semaphore is a counting semaphore shared by all job goroutines.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	return make(semaphore, n)
+}
+
+// acquire blocks until a slot is free or ctx is cancelled.
+func (s semaphore) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
+
+// runPool starts Limits.Jobs consumers and blocks until they all return.
+// Consumers stop pulling jobs once stopCtx is done; jobCtx is handed to the
+// jobs themselves and is only cancelled when the shutdown grace period ends.
+func (w *Worker) runPool(stopCtx, jobCtx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < w.limits.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.consume(stopCtx, jobCtx)
+		}()
+	}
+	wg.Wait()
+}
+
+// consume pops and handles jobs one at a time until stopCtx is cancelled.
+func (w *Worker) consume(stopCtx, jobCtx context.Context) {
+	// Queue bookkeeping must still succeed after the job context is cancelled.
+	bg := context.WithoutCancel(jobCtx)
+	for stopCtx.Err() == nil {
+		payload, err := w.queue.Pop(stopCtx, 5*time.Second)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if stopCtx.Err() == nil {
+				log.Printf("❌ Failed to pop job from redis: %v", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		var job VideoJob
+		if err := json.Unmarshal([]byte(payload), &job); err != nil {
+			log.Printf("❌ Failed to parse job JSON, dropping it: %v", err)
+			w.queue.Ack(bg, payload)
+			continue
+		}
+
+		if err := w.handleJob(jobCtx, job); err == errJobInterrupted {
+			if err := w.queue.Requeue(bg, payload); err != nil {
+				log.Printf("❌ Failed to re-queue interrupted job for video ID %d: %v", job.VideoID, err)
+			} else {
+				log.Printf("↩️ Re-queued interrupted job for video ID %d", job.VideoID)
+			}
+			continue
+		}
+		if err := w.queue.Ack(bg, payload); err != nil {
+			log.Printf("❌ Failed to acknowledge job for video ID %d: %v", job.VideoID, err)
+		}
+	}
+}
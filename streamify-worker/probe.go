@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceInfo is the normalized ffprobe output for a source file.
+type SourceInfo struct {
+	Width    int
+	Height   int
+	HasAudio bool
+	// Duration is the container duration, zero when ffprobe cannot tell.
+	Duration      time.Duration
+	FrameRate     float64
+	VideoCodec    string
+	AudioCodec    string
+	AudioChannels int
+	// BitRate is the overall bitrate in bits per second.
+	BitRate   int64
+	SizeBytes int64
+	Container string
+	// AudioTracks lists every audio stream in source order; AudioCodec and
+	// AudioChannels describe the first.
+	AudioTracks []AudioTrack
+	// SubtitleTracks lists every subtitle stream in source order.
+	SubtitleTracks []SubtitleTrack
+	// Raw is ffprobe's complete JSON output.
+	Raw json.RawMessage
+}
+
+// AudioTrack is one audio stream of the source.
+type AudioTrack struct {
+	Language      string `json:"language,omitempty"`
+	Title         string `json:"title,omitempty"`
+	Codec         string `json:"codec"`
+	Channels      int    `json:"channels"`
+	ChannelLayout string `json:"channel_layout,omitempty"`
+	// Default is the source's default disposition.
+	Default bool `json:"default"`
+}
+
+// SubtitleTrack is one subtitle stream of the source.
+type SubtitleTrack struct {
+	Codec    string
+	Language string
+	Title    string
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType     string `json:"codec_type"`
+		CodecName     string `json:"codec_name"`
+		Width         int    `json:"width"`
+		Height        int    `json:"height"`
+		AvgFrameRate  string `json:"avg_frame_rate"`
+		RFrameRate    string `json:"r_frame_rate"`
+		Channels      int    `json:"channels"`
+		ChannelLayout string `json:"channel_layout"`
+		Disposition   struct {
+			Default int `json:"default"`
+		} `json:"disposition"`
+		Tags struct {
+			Language string `json:"language"`
+			Title    string `json:"title"`
+		} `json:"tags"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// probeSource runs ffprobe on the input file. ffprobe only reads the
+// container headers, so it gets the shortest time limit. Failures are
+// classified like ffmpeg's; a source without a video stream is permanent.
+func probeSource(ctx context.Context, process ProcessLimits, inputPath string) (SourceInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, process.MinTimeout)
+	defer cancel()
+	cmd := process.command(ctx, "ffprobe", []string{"-v", "error", "-print_format", "json", "-show_streams", "-show_format", inputPath})
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return SourceInfo{}, ffmpegError("source is not a readable video", err, stderr.String())
+	}
+
+	var out ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return SourceInfo{}, retryableError("could not parse ffprobe output", err)
+	}
+
+	info := SourceInfo{Raw: json.RawMessage(stdout.Bytes())}
+	for _, s := range out.Streams {
+		switch s.CodecType {
+		case "video":
+			if info.Width == 0 {
+				info.Width, info.Height = s.Width, s.Height
+				info.VideoCodec = s.CodecName
+				info.FrameRate = parseFrameRate(s.AvgFrameRate)
+				if info.FrameRate == 0 {
+					info.FrameRate = parseFrameRate(s.RFrameRate)
+				}
+			}
+		case "audio":
+			if !info.HasAudio {
+				info.HasAudio = true
+				info.AudioCodec = s.CodecName
+				info.AudioChannels = s.Channels
+			}
+			lang := s.Tags.Language
+			if lang == "und" {
+				lang = ""
+			}
+			info.AudioTracks = append(info.AudioTracks, AudioTrack{
+				Language:      lang,
+				Title:         s.Tags.Title,
+				Codec:         s.CodecName,
+				Channels:      s.Channels,
+				ChannelLayout: s.ChannelLayout,
+				Default:       s.Disposition.Default == 1,
+			})
+		case "subtitle":
+			lang := s.Tags.Language
+			if lang == "und" {
+				lang = ""
+			}
+			info.SubtitleTracks = append(info.SubtitleTracks, SubtitleTrack{Codec: s.CodecName, Language: lang, Title: s.Tags.Title})
+		}
+	}
+	if secs, err := strconv.ParseFloat(out.Format.Duration, 64); err == nil && secs > 0 {
+		info.Duration = time.Duration(secs * float64(time.Second))
+	}
+	info.BitRate, _ = strconv.ParseInt(out.Format.BitRate, 10, 64)
+	info.SizeBytes, _ = strconv.ParseInt(out.Format.Size, 10, 64)
+	info.Container = out.Format.FormatName
+	if info.Width == 0 || info.Height == 0 {
+		return info, permanentError("source has no video stream", errors.New("no video stream found"))
+	}
+	return info, nil
+}
+
+// parseFrameRate turns ffprobe's rational "30000/1001" into 29.97.
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(rate, 64)
+		return f
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// saveMediaMetadata stores the normalized probe result and the raw ffprobe
+// JSON for a video, replacing any earlier probe.
+func saveMediaMetadata(db *sql.DB, videoID int, info SourceInfo) error {
+	tracks, err := json.Marshal(info.AudioTracks)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO video_metadata (video_id, duration_seconds, width, height, frame_rate, video_codec,
+		audio_codec, audio_channels, bit_rate, size_bytes, container, probe, audio_tracks)
+	VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10, $11, $12, $13)
+	ON CONFLICT (video_id) DO UPDATE SET
+		duration_seconds = EXCLUDED.duration_seconds, width = EXCLUDED.width, height = EXCLUDED.height,
+		frame_rate = EXCLUDED.frame_rate, video_codec = EXCLUDED.video_codec, audio_codec = EXCLUDED.audio_codec,
+		audio_channels = EXCLUDED.audio_channels, bit_rate = EXCLUDED.bit_rate, size_bytes = EXCLUDED.size_bytes,
+		container = EXCLUDED.container, probe = EXCLUDED.probe, audio_tracks = EXCLUDED.audio_tracks, probed_at = NOW()`
+	_, err = db.Exec(query, videoID, info.Duration.Seconds(), info.Width, info.Height, info.FrameRate,
+		info.VideoCodec, info.AudioCodec, info.AudioChannels, info.BitRate, info.SizeBytes, info.Container, []byte(info.Raw), tracks)
+	return err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Video codecs an encoding profile can use.
+const (
+	CodecH264 = "h264"
+	CodecHEVC = "hevc"
+	CodecAV1  = "av1"
+	CodecVP9  = "vp9"
+)
+
+const defaultProfileName = "standard"
+
+// EncodingProfile holds the encoder settings shared by every rendition.
+type EncodingProfile struct {
+	Codec string
+	// CodecProfile is the codec's own profile, e.g. "main" or "high" for H.264
+	// and "0" for VP9.
+	CodecProfile string
+	// Preset is the encoder speed: -preset for x264, x265 and SVT-AV1 and
+	// -cpu-used for VP9.
+	Preset string
+	// CRF is the constant rate factor, capped by each rendition's maximum
+	// bitrate. Zero switches to bitrate mode, targeting the rendition bitrate.
+	CRF int
+	// GOPSeconds is the keyframe interval. It divides the segment duration so
+	// every segment of every rendition starts on a keyframe.
+	GOPSeconds int
+
+	// Audio is always AAC-LC, which every HLS and DASH player supports.
+	AudioBitrateKbps int
+	AudioChannels    int
+}
+
+// encodingProfiles maps the profile names accepted by the API to encoder settings.
+var encodingProfiles = map[string]EncodingProfile{
+	"standard":      {Codec: CodecH264, CodecProfile: "main", Preset: "medium", CRF: 23, GOPSeconds: 2, AudioBitrateKbps: 128, AudioChannels: 2},
+	"high_quality":  {Codec: CodecH264, CodecProfile: "high", Preset: "slow", CRF: 18, GOPSeconds: 2, AudioBitrateKbps: 192, AudioChannels: 2},
+	"fast":          {Codec: CodecH264, CodecProfile: "main", Preset: "veryfast", CRF: 26, GOPSeconds: 2, AudioBitrateKbps: 128, AudioChannels: 2},
+	"fixed_bitrate": {Codec: CodecH264, CodecProfile: "high", Preset: "medium", GOPSeconds: 2, AudioBitrateKbps: 128, AudioChannels: 2},
+	"hevc":          {Codec: CodecHEVC, CodecProfile: "main", Preset: "medium", CRF: 26, GOPSeconds: 2, AudioBitrateKbps: 128, AudioChannels: 2},
+	"av1":           {Codec: CodecAV1, CodecProfile: "main", Preset: "8", CRF: 35, GOPSeconds: 2, AudioBitrateKbps: 128, AudioChannels: 2},
+	"vp9":           {Codec: CodecVP9, CodecProfile: "0", Preset: "2", CRF: 33, GOPSeconds: 2, AudioBitrateKbps: 128, AudioChannels: 2},
+}
+
+func lookupProfile(name string) EncodingProfile {
+	if p, ok := encodingProfiles[name]; ok {
+		return p
+	}
+	return encodingProfiles[defaultProfileName]
+}
+
+// compatibilityProfile encodes the H.264 renditions added to the ladder of
+// profiles using newer codecs, for players that cannot decode them.
+func compatibilityProfile(p EncodingProfile) EncodingProfile {
+	c := encodingProfiles[defaultProfileName]
+	c.GOPSeconds = p.GOPSeconds
+	c.AudioBitrateKbps, c.AudioChannels = p.AudioBitrateKbps, p.AudioChannels
+	return c
+}
+
+// bitrateScale shrinks the H.264 ladder bitrates for codecs that reach the
+// same quality with fewer bits.
+var bitrateScale = map[string]float64{
+	CodecH264: 1,
+	CodecHEVC: 0.6,
+	CodecAV1:  0.5,
+	CodecVP9:  0.65,
+}
+
+// needsFMP4 reports whether the profile's video cannot be carried in MPEG-TS
+// segments and HLS output must use fragmented MP4 instead.
+func (p EncodingProfile) needsFMP4() bool {
+	return p.Codec != CodecH264
+}
+
+// gopFrames converts the keyframe interval into frames at the source rate.
+func (p EncodingProfile) gopFrames(frameRate float64) int {
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	return int(math.Round(frameRate * float64(p.GOPSeconds)))
+}
+
+// videoEncoderArgs returns the per-stream encoder options for output video
+// stream n.
+func videoEncoderArgs(n int, r Rendition, p EncodingProfile, frameRate float64) []string {
+	s := ":v:" + strconv.Itoa(n)
+	gop := strconv.Itoa(p.gopFrames(frameRate))
+	maxRate := fmt.Sprintf("%dk", r.MaxRateKbps)
+	args := []string{"-maxrate" + s, maxRate, "-bufsize" + s, fmt.Sprintf("%dk", r.BufSizeKbps)}
+	if p.CRF == 0 {
+		args = append(args, "-b"+s, fmt.Sprintf("%dk", r.MaxRateKbps*3/4))
+	}
+
+	switch p.Codec {
+	case CodecHEVC:
+		args = append(args,
+			"-c"+s, "libx265",
+			"-tag"+s, "hvc1",
+			"-profile"+s, p.CodecProfile,
+			"-preset"+s, p.Preset,
+			"-x265-params"+s, fmt.Sprintf("keyint=%s:min-keyint=%s:scenecut=0:open-gop=0:log-level=error", gop, gop),
+		)
+	case CodecAV1:
+		args = append(args,
+			"-c"+s, "libsvtav1",
+			"-preset"+s, p.Preset,
+			"-g"+s, gop,
+			"-svtav1-params"+s, "scd=0",
+		)
+	case CodecVP9:
+		args = append(args,
+			"-c"+s, "libvpx-vp9",
+			"-profile"+s, p.CodecProfile,
+			"-deadline"+s, "good",
+			"-cpu-used"+s, p.Preset,
+			"-row-mt"+s, "1",
+			"-g"+s, gop,
+			"-keyint_min"+s, gop,
+		)
+		if p.CRF != 0 {
+			// libvpx runs constrained quality when given both a CRF and a bitrate.
+			args = append(args, "-b"+s, maxRate)
+		}
+	default:
+		args = append(args,
+			"-c"+s, "libx264",
+			"-profile"+s, p.CodecProfile,
+			"-level"+s, fmt.Sprintf("%d.%d", r.Level/10, r.Level%10),
+			"-preset"+s, p.Preset,
+			"-g"+s, gop,
+			"-keyint_min"+s, gop,
+			"-sc_threshold"+s, "0",
+		)
+	}
+	if p.CRF != 0 {
+		args = append(args, "-crf"+s, strconv.Itoa(p.CRF))
+	}
+	return args
+}
+
+// audioEncoderArgs returns the options for output audio stream n, encoded
+// from the given source track.
+func audioEncoderArgs(n int, track AudioTrack, p EncodingProfile) []string {
+	s := ":a:" + strconv.Itoa(n)
+	args := []string{
+		"-c" + s, "aac",
+		"-b" + s, fmt.Sprintf("%dk", p.AudioBitrateKbps),
+		"-ac" + s, strconv.Itoa(outputChannels(track, p)),
+	}
+	if track.Language != "" {
+		args = append(args, "-metadata:s"+s, "language="+track.Language)
+	}
+	return args
+}
+
+// outputChannels downmixes to the profile's channel count but never upmixes,
+// so mono commentary tracks stay mono.
+func outputChannels(track AudioTrack, p EncodingProfile) int {
+	if track.Channels > 0 && track.Channels < p.AudioChannels {
+		return track.Channels
+	}
+	return p.AudioChannels
+}
+
+// videoCodecString returns the RFC 6381 codec string advertised in the
+// master playlist for a rendition.
+func videoCodecString(r Rendition, p EncodingProfile) string {
+	switch r.Codec {
+	case CodecHEVC:
+		// HEVC's general_level_idc is 30 times the level, e.g. L93 for 3.1.
+		return fmt.Sprintf("hvc1.1.6.L%d.90", r.Level*3)
+	case CodecAV1:
+		return fmt.Sprintf("av01.0.%02dM.08", av1Level(r.Height))
+	case CodecVP9:
+		return fmt.Sprintf("vp09.0%s.%02d.08", p.CodecProfile, r.Level)
+	default:
+		return h264Codec(p.CodecProfile, r.Level)
+	}
+}
+
+// h264Codec returns the RFC 6381 codec string, e.g. avc1.4d401f for Main@3.1.
+func h264Codec(profile string, level int) string {
+	profileIDC := map[string]string{"baseline": "42e0", "main": "4d40", "high": "6400"}[profile]
+	if profileIDC == "" {
+		profileIDC = "4d40"
+	}
+	return fmt.Sprintf("avc1.%s%02x", profileIDC, level)
+}
+
+// av1Level returns the AV1 seq_level_idx for a rendition height.
+func av1Level(height int) int {
+	switch {
+	case height > 720:
+		return 8 // 4.0
+	case height > 480:
+		return 5 // 3.1
+	default:
+		return 4 // 3.0
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const progressInterval = 2 * time.Second
+
+// Processing stages reported to the API while a video is processing.
+const (
+	stageDownloading = "downloading"
+	stageScanning    = "scanning"
+	stageProbing     = "probing"
+	stageTranscoding = "transcoding"
+	stageImages      = "generating_images"
+	stageUploading   = "uploading"
+)
+
+// progressReporter writes a job's current stage, percentage and ETA to its
+// videos row. Updates within a stage are throttled to one per
+// progressInterval so long encodes don't hammer the database.
+type progressReporter struct {
+	db           *sql.DB
+	videoID      int
+	stage        string
+	stageStarted time.Time
+	lastWrite    time.Time
+}
+
+func newProgressReporter(db *sql.DB, videoID int) *progressReporter {
+	return &progressReporter{db: db, videoID: videoID}
+}
+
+// Stage starts a new stage at 0%.
+func (p *progressReporter) Stage(stage string) {
+	p.stage = stage
+	p.stageStarted = time.Now()
+	p.write(0, -1)
+}
+
+// Update reports the percentage complete (0-100) of the current stage.
+func (p *progressReporter) Update(percent float64) {
+	if time.Since(p.lastWrite) < progressInterval {
+		return
+	}
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	eta := -1
+	if percent > 0 {
+		elapsed := time.Since(p.stageStarted).Seconds()
+		eta = int(elapsed * (100 - percent) / percent)
+	}
+	p.write(percent, eta)
+}
+
+func (p *progressReporter) write(percent float64, etaSeconds int) {
+	p.lastWrite = time.Now()
+	query := `
+	UPDATE videos SET progress_stage = $1, progress_percent = $2,
+		progress_eta_seconds = NULLIF($3, -1), progress_updated_at = NOW()
+	WHERE id = $4`
+	if _, err := p.db.Exec(query, p.stage, percent, etaSeconds, p.videoID); err != nil {
+		log.Printf("❌ Failed to report progress for video ID %d: %v", p.videoID, err)
+	}
+}
+
+// readFFmpegProgress parses the key=value stream ffmpeg writes with
+// `-progress pipe:1` and reports each out_time, the position ffmpeg has
+// written up to.
+func readFFmpegProgress(r io.Reader, report func(outTime time.Duration)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		// out_time_us is microseconds; older ffmpeg builds mislabel the same
+		// value as out_time_ms.
+		if key != "out_time_us" && key != "out_time_ms" {
+			continue
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || us < 0 {
+			continue
+		}
+		report(time.Duration(us) * time.Microsecond)
+	}
+	// Drain so ffmpeg never blocks on a full pipe.
+	io.Copy(io.Discard, r)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	jobQueue        = "video_jobs"
+	workersSet      = "video_workers"
+	heartbeatTTL    = 30 * time.Second
+	heartbeatPeriod = 10 * time.Second
+	recoveryPeriod  = time.Minute
+	promotePeriod   = time.Second
+)
+
+// Queue is a reliable Redis queue. Popping a job atomically moves it into a
+// processing list owned by this worker, and the job only leaves that list once
+// it is acknowledged. If a worker dies, its heartbeat expires and any live
+// worker's recovery sweep puts the unacknowledged jobs back into the ready
+// set where they were.
+type Queue struct {
+	rdb      *redis.Client
+	workerID string
+	policy   SchedulePolicy
+}
+
+func NewQueue(rdb *redis.Client) *Queue {
+	host, _ := os.Hostname()
+	return &Queue{
+		rdb:      rdb,
+		workerID: fmt.Sprintf("%s-%d-%04x", host, os.Getpid(), rand.Intn(0x10000)),
+		policy:   schedulePolicyFromEnv(),
+	}
+}
+
+func (q *Queue) WorkerID() string {
+	return q.workerID
+}
+
+func processingList(workerID string) string {
+	return jobQueue + ":processing:" + workerID
+}
+
+// processingScores holds the ready set score of each job in a worker's
+// processing list.
+func processingScores(workerID string) string {
+	return processingList(workerID) + ":scores"
+}
+
+func heartbeatKey(workerID string) string {
+	return "video_worker:" + workerID + ":heartbeat"
+}
+
+func jobLockKey(videoID int) string {
+	return "video_lock:" + strconv.Itoa(videoID)
+}
+
+// Ack removes a finished job from this worker's processing list.
+func (q *Queue) Ack(ctx context.Context, payload string) error {
+	pipe := q.rdb.TxPipeline()
+	pipe.LRem(ctx, processingList(q.workerID), 1, payload)
+	pipe.HDel(ctx, processingScores(q.workerID), payload)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Register announces this worker so that others can detect when it dies.
+func (q *Queue) Register(ctx context.Context) error {
+	if err := q.beat(ctx); err != nil {
+		return err
+	}
+	return q.rdb.SAdd(ctx, workersSet, q.workerID).Err()
+}
+
+// Deregister removes this worker after a clean shutdown. Jobs still in its
+// processing list, such as one popped as shutdown began, go back on the
+// queue first; once the worker is gone no recovery sweep would find them.
+func (q *Queue) Deregister(ctx context.Context) error {
+	n, err := q.requeueAll(ctx, q.workerID)
+	if err != nil {
+		// Stay registered so a recovery sweep re-queues them once the
+		// heartbeat expires.
+		return fmt.Errorf("failed to re-queue in-flight jobs: %w", err)
+	}
+	if n > 0 {
+		log.Printf("♻️ Re-queued %d unfinished job(s) on shutdown", n)
+	}
+	pipe := q.rdb.TxPipeline()
+	pipe.SRem(ctx, workersSet, q.workerID)
+	pipe.Del(ctx, heartbeatKey(q.workerID))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Requeue puts an unfinished job back at the front of the ready set.
+func (q *Queue) Requeue(ctx context.Context, payload string) error {
+	pipe := q.rdb.TxPipeline()
+	pipe.LRem(ctx, processingList(q.workerID), 1, payload)
+	pipe.HDel(ctx, processingScores(q.workerID), payload)
+	pipe.ZAdd(ctx, readyQueue, redis.Z{Score: 0, Member: payload})
+	pipe.HIncrBy(ctx, tenantQueuedKey, tenantField(payload), 1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (q *Queue) beat(ctx context.Context) error {
+	return q.rdb.Set(ctx, heartbeatKey(q.workerID), time.Now().Unix(), heartbeatTTL).Err()
+}
+
+// Run keeps the heartbeat alive, promotes delayed retries that are due and
+// periodically sweeps dead workers until ctx is cancelled.
+func (q *Queue) Run(ctx context.Context) {
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+	recovery := time.NewTicker(recoveryPeriod)
+	defer recovery.Stop()
+	promote := time.NewTicker(promotePeriod)
+	defer promote.Stop()
+
+	q.RecoverDead(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if err := q.beat(ctx); err != nil {
+				log.Printf("❌ Failed to send worker heartbeat: %v", err)
+			}
+		case <-recovery.C:
+			q.RecoverDead(ctx)
+		case <-promote.C:
+			if _, err := q.PromoteDue(ctx); err != nil {
+				log.Printf("❌ Failed to promote delayed jobs: %v", err)
+			}
+		}
+	}
+}
+
+// RecoverDead re-queues the in-flight jobs of every registered worker whose
+// heartbeat has expired, then forgets that worker.
+func (q *Queue) RecoverDead(ctx context.Context) {
+	workers, err := q.rdb.SMembers(ctx, workersSet).Result()
+	if err != nil {
+		log.Printf("❌ Recovery sweep failed to list workers: %v", err)
+		return
+	}
+	for _, id := range workers {
+		if id == q.workerID {
+			continue
+		}
+		alive, err := q.rdb.Exists(ctx, heartbeatKey(id)).Result()
+		if err != nil || alive == 1 {
+			continue
+		}
+		n, err := q.requeueAll(ctx, id)
+		if err != nil {
+			log.Printf("❌ Failed to recover jobs from dead worker %s: %v", id, err)
+			continue
+		}
+		q.rdb.SRem(ctx, workersSet, id)
+		if n > 0 {
+			log.Printf("♻️ Re-queued %d job(s) from dead worker %s", n, id)
+		}
+	}
+}
+
+// requeueAll moves every job in a worker's processing list back into the
+// ready set, releasing any per-video lock the dead worker still holds.
+func (q *Queue) requeueAll(ctx context.Context, workerID string) (int, error) {
+	n := 0
+	for {
+		keys := []string{processingList(workerID), processingScores(workerID), readyQueue, tenantQueuedKey}
+		payload, err := recoverScript.Run(ctx, q.rdb, keys).Text()
+		if err == redis.Nil {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+
+		var job VideoJob
+		if json.Unmarshal([]byte(payload), &job) == nil {
+			q.releaseLockIfOwner(ctx, job.VideoID, workerID)
+		}
+	}
+}
+
+// releaseLockIfOwner deletes a video lock only if owner still holds it.
+func (q *Queue) releaseLockIfOwner(ctx context.Context, videoID int, owner string) {
+	const script = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+	q.rdb.Eval(ctx, script, []string{jobLockKey(videoID)}, owner)
+}
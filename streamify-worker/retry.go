@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	delayedQueue    = jobQueue + ":delayed"
+	deadLetterQueue = jobQueue + ":dead"
+)
+
+// RetryPolicy controls how retryable failures are re-attempted.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func retryPolicyFromEnv() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: envInt("JOB_MAX_ATTEMPTS", 5),
+		BaseDelay:   envDuration("JOB_RETRY_BASE_DELAY", 30*time.Second),
+		MaxDelay:    envDuration("JOB_RETRY_MAX_DELAY", 30*time.Minute),
+	}
+}
+
+// Backoff returns the delay before the given retry (1-based): exponential
+// growth capped at MaxDelay, with "equal jitter" so retries of jobs that
+// failed together spread out.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// DeadLetter is an exhausted job kept for inspection and replay.
+type DeadLetter struct {
+	Job      VideoJob  `json:"job"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// Schedule puts job in the delayed set to be re-queued after delay.
+func (q *Queue) Schedule(ctx context.Context, job VideoJob, delay time.Duration) error {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.rdb.ZAdd(ctx, delayedQueue, redis.Z{
+		Score:  float64(time.Now().Add(delay).Unix()),
+		Member: payload,
+	}).Err()
+}
+
+// DeadLetter records a job that ran out of retries.
+func (q *Queue) DeadLetter(ctx context.Context, job VideoJob, cause error) error {
+	payload, err := json.Marshal(DeadLetter{Job: job, Error: cause.Error(), FailedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return q.rdb.LPush(ctx, deadLetterQueue, payload).Err()
+}
+
+// promoteDueScript moves due members of the delayed set onto the queue in one
+// step, so two workers promoting at once cannot duplicate a job.
+var promoteDueScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 100)
+for _, job in ipairs(due) do
+	redis.call("ZREM", KEYS[1], job)
+	redis.call("LPUSH", KEYS[2], job)
+end
+return #due`)
+
+// PromoteDue re-queues delayed jobs whose retry time has passed.
+func (q *Queue) PromoteDue(ctx context.Context) (int, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	return promoteDueScript.Run(ctx, q.rdb, []string{delayedQueue, jobQueue}, now).Int()
+}
+
+// ListDeadLetters returns up to limit dead-lettered jobs, newest first.
+func (q *Queue) ListDeadLetters(ctx context.Context, limit int64) ([]DeadLetter, error) {
+	raw, err := q.rdb.LRange(ctx, deadLetterQueue, 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(raw))
+	for _, r := range raw {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(r), &dl); err == nil {
+			letters = append(letters, dl)
+		}
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters re-queues dead-lettered jobs with a fresh retry budget.
+// If videoID is non-zero only that video's jobs are replayed. prepare runs
+// before each job is pushed, so the caller can reset the video's status.
+func (q *Queue) ReplayDeadLetters(ctx context.Context, videoID int, prepare func(VideoJob) error) ([]VideoJob, error) {
+	raw, err := q.rdb.LRange(ctx, deadLetterQueue, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var replayed []VideoJob
+	for _, r := range raw {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(r), &dl); err != nil {
+			continue
+		}
+		if videoID != 0 && dl.Job.VideoID != videoID {
+			continue
+		}
+		removed, err := q.rdb.LRem(ctx, deadLetterQueue, 1, r).Result()
+		if err != nil {
+			return replayed, err
+		}
+		if removed == 0 {
+			continue
+		}
+		job := dl.Job
+		job.Attempt = 0
+		job.LastError = ""
+		if err := prepare(job); err != nil {
+			q.rdb.LPush(ctx, deadLetterQueue, r)
+			return replayed, err
+		}
+		payload, err := json.Marshal(job)
+		if err != nil {
+			return replayed, err
+		}
+		if err := q.rdb.LPush(ctx, jobQueue, payload).Err(); err != nil {
+			return replayed, err
+		}
+		replayed = append(replayed, job)
+	}
+	return replayed, nil
+}
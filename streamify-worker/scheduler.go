@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Jobs arrive on jobQueue in submission order. Workers move them into
+// readyQueue, a sorted set ordered by when each job should run, and always
+// take the earliest. tenantNextKey holds, per user and priority, the earliest
+// slot that user's next job at that priority can get, and tenantQueuedKey
+// counts their waiting jobs so the slot resets once their backlog drains.
+const (
+	readyQueue       = jobQueue + ":ready"
+	tenantNextKey    = jobQueue + ":tenant_next"
+	tenantQueuedKey  = jobQueue + ":tenant_queued"
+	tenantWeightsKey = jobQueue + ":tenant_weights"
+	scheduleBatch    = 100
+)
+
+// SchedulePolicy controls the order jobs run in. A job's slot is the time it
+// arrived plus its priority's delay, so a job of lower priority runs after
+// higher priority jobs that arrive within the delay, but never waits behind
+// work submitted long after it. Each user's jobs at one priority are also
+// spaced FairShare apart, divided by the user's weight, so a user who queues
+// hundreds of jobs at once takes turns with everyone else.
+type SchedulePolicy struct {
+	FairShare   time.Duration
+	NormalDelay time.Duration
+	LowDelay    time.Duration
+}
+
+func schedulePolicyFromEnv() SchedulePolicy {
+	return SchedulePolicy{
+		FairShare:   envDuration("QUEUE_FAIR_SHARE", time.Minute),
+		NormalDelay: envDuration("QUEUE_NORMAL_PRIORITY_DELAY", 2*time.Minute),
+		LowDelay:    envDuration("QUEUE_LOW_PRIORITY_DELAY", 30*time.Minute),
+	}
+}
+
+// tenantOfScript is the Lua twin of tenantField, shared by the scripts.
+const tenantOfScript = `
+local priorities = {high = true, normal = true, low = true}
+
+local function tenantOf(payload)
+	local ok, job = pcall(cjson.decode, payload)
+	local tenant, priority = "0", "normal"
+	if ok and type(job) == "table" then
+		if type(job.user_id) == "number" then tenant = string.format("%d", job.user_id) end
+		if priorities[job.priority] then priority = job.priority end
+	end
+	return tenant, priority
+end
+`
+
+// scheduleScript moves newly arrived jobs into the ready set, then pops the
+// earliest ready job into the worker's processing list, remembering its
+// score for recovery. It runs atomically, so a job is always in exactly one
+// of the lists.
+var scheduleScript = redis.NewScript(tenantOfScript + `
+local now, share = tonumber(ARGV[1]), tonumber(ARGV[2])
+local delays = {high = 0, normal = tonumber(ARGV[3]), low = tonumber(ARGV[4])}
+
+for _ = 1, tonumber(ARGV[5]) do
+	local payload = redis.call("RPOP", KEYS[1])
+	if not payload then break end
+	local tenant, priority = tenantOf(payload)
+	local field = tenant .. ":" .. priority
+	local weight = tonumber(redis.call("HGET", KEYS[5], tenant)) or 1
+	if weight <= 0 then weight = 1 end
+	local slot = math.max(now, tonumber(redis.call("HGET", KEYS[3], field)) or 0)
+	-- A duplicate delivery of a waiting job is dropped here.
+	if redis.call("ZADD", KEYS[2], "NX", slot + delays[priority], payload) == 1 then
+		redis.call("HSET", KEYS[3], field, slot + share / weight)
+		redis.call("HINCRBY", KEYS[4], field, 1)
+	end
+end
+
+local popped = redis.call("ZPOPMIN", KEYS[2])
+if #popped == 0 then return false end
+local payload = popped[1]
+redis.call("LPUSH", KEYS[6], payload)
+redis.call("HSET", KEYS[7], payload, popped[2])
+local tenant, priority = tenantOf(payload)
+local field = tenant .. ":" .. priority
+if redis.call("HINCRBY", KEYS[4], field, -1) <= 0 then
+	redis.call("HDEL", KEYS[4], field)
+	redis.call("HDEL", KEYS[3], field)
+end
+return payload`)
+
+// recoverScript moves the oldest job of a processing list back into the ready
+// set at the score it was popped with, so a recovered job keeps its place
+// instead of arriving again behind newer work. Jobs without a recorded score
+// go to the front, like Requeue puts them.
+var recoverScript = redis.NewScript(tenantOfScript + `
+local payload = redis.call("RPOP", KEYS[1])
+if not payload then return false end
+local score = tonumber(redis.call("HGET", KEYS[2], payload)) or 0
+redis.call("HDEL", KEYS[2], payload)
+-- A copy already waiting keeps its own place.
+if redis.call("ZADD", KEYS[3], "NX", score, payload) == 1 then
+	local tenant, priority = tenantOf(payload)
+	redis.call("HINCRBY", KEYS[4], tenant .. ":" .. priority, 1)
+end
+return payload`)
+
+// Pop blocks until a job is available or timeout elapses, returning redis.Nil
+// on timeout. The job is the earliest in the ready set after scheduling every
+// newly arrived job; see SchedulePolicy.
+func (q *Queue) Pop(ctx context.Context, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		payload, err := scheduleScript.Run(ctx, q.rdb,
+			[]string{jobQueue, readyQueue, tenantNextKey, tenantQueuedKey, tenantWeightsKey, processingList(q.workerID), processingScores(q.workerID)},
+			time.Now().Unix(),
+			int64(q.policy.FairShare.Seconds()),
+			int64(q.policy.NormalDelay.Seconds()),
+			int64(q.policy.LowDelay.Seconds()),
+			scheduleBatch,
+		).Text()
+		if err != redis.Nil {
+			return payload, err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return "", redis.Nil
+		}
+		// Wait for a job to arrive. Moving the tail of a list onto itself
+		// leaves the list unchanged.
+		if err := q.rdb.BLMove(ctx, jobQueue, jobQueue, "RIGHT", "RIGHT", wait).Err(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// tenantField is the scheduler's per-user, per-priority field for a job,
+// matching tenantOf in scheduleScript.
+func tenantField(payload string) string {
+	var job VideoJob
+	json.Unmarshal([]byte(payload), &job)
+	switch job.Priority {
+	case "high", "normal", "low":
+	default:
+		job.Priority = "normal"
+	}
+	return strconv.Itoa(job.UserID) + ":" + job.Priority
+}
+
+// SetTenantWeight gives a user a larger (or, with a weight below 1, a
+// smaller) share of the workers. Weight 1 is the default.
+func (q *Queue) SetTenantWeight(ctx context.Context, userID int, weight float64) error {
+	if weight == 1 {
+		return q.rdb.HDel(ctx, tenantWeightsKey, strconv.Itoa(userID)).Err()
+	}
+	return q.rdb.HSet(ctx, tenantWeightsKey, strconv.Itoa(userID), weight).Err()
+}
+
+const queueUsage = "usage: worker queue stats | worker queue weight <user_id> <weight>"
+
+// runQueueCommand lets an operator inspect the queue and adjust user weights,
+// e.g. `docker compose exec worker ./worker queue weight 42 4`.
+func runQueueCommand(ctx context.Context, q *Queue, args []string) error {
+	if len(args) == 0 {
+		return errors.New(queueUsage)
+	}
+
+	switch args[0] {
+	case "stats":
+		arrived, err := q.rdb.LLen(ctx, jobQueue).Result()
+		if err != nil {
+			return err
+		}
+		ready, err := q.rdb.ZCard(ctx, readyQueue).Result()
+		if err != nil {
+			return err
+		}
+		queued, err := q.rdb.HGetAll(ctx, tenantQueuedKey).Result()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Arrived: %d\nReady: %d\n", arrived, ready)
+		for field, n := range queued {
+			fmt.Printf("  user:priority %s: %s waiting\n", field, n)
+		}
+		return nil
+
+	case "weight":
+		if len(args) < 3 {
+			return errors.New(queueUsage)
+		}
+		userID, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.New(queueUsage)
+		}
+		weight, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || weight <= 0 {
+			return errors.New("weight must be a positive number")
+		}
+		if err := q.SetTenantWeight(ctx, userID, weight); err != nil {
+			return fmt.Errorf("failed to set weight: %w", err)
+		}
+		fmt.Printf("User %d now has weight %g\n", userID, weight)
+		return nil
+
+	default:
+		return errors.New(queueUsage)
+	}
+}
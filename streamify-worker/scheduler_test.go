@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRecoverDeadKeepsReadyScore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	policy := SchedulePolicy{FairShare: time.Minute, NormalDelay: 2 * time.Minute, LowDelay: 30 * time.Minute}
+	dead := &Queue{rdb: rdb, workerID: "dead", policy: policy}
+	live := &Queue{rdb: rdb, workerID: "live", policy: policy}
+
+	job := `{"video_id":1,"user_id":7,"priority":"low"}`
+	if err := rdb.LPush(ctx, jobQueue, job).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := dead.Pop(ctx, time.Second); err != nil || payload != job {
+		t.Fatalf("Pop() = %q, %v; want the job", payload, err)
+	}
+	score, err := rdb.HGet(ctx, processingScores("dead"), job).Float64()
+	if err != nil {
+		t.Fatalf("popped job has no recorded score: %v", err)
+	}
+	// The dead worker is registered but its heartbeat has expired.
+	rdb.SAdd(ctx, workersSet, "dead")
+
+	live.RecoverDead(ctx)
+
+	if got, err := rdb.ZScore(ctx, readyQueue, job).Result(); err != nil || got != score {
+		t.Errorf("ready score = %v, %v; want the original %v", got, err, score)
+	}
+	if n, _ := rdb.LLen(ctx, jobQueue).Result(); n != 0 {
+		t.Errorf("%d jobs back on the arrival list, want none", n)
+	}
+	if n, _ := rdb.HGet(ctx, tenantQueuedKey, "7:low").Int(); n != 1 {
+		t.Errorf("user 7 has %d low priority jobs waiting, want 1", n)
+	}
+	if mr.Exists(processingList("dead")) || mr.Exists(processingScores("dead")) {
+		t.Error("the dead worker's processing state was left behind")
+	}
+}
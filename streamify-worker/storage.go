@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// defaultLocalStorageDir matches the backend's default, which serves the
+// directory over HTTP.
+const defaultLocalStorageDir = "/app/media"
+
+// errObjectNotFound is returned by Storage.Get when the key does not exist.
+var errObjectNotFound = errors.New("storage: object not found")
+
+// PutOptions are the response headers stored with an object.
+type PutOptions struct {
+	ContentType  string
+	CacheControl string
+}
+
+// Storage is where processed media is published, addressed by
+// slash-separated keys.
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns every key that starts with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// DeletePrefix deletes every key that starts with prefix and returns how
+	// many were deleted.
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
+	// Presign returns a URL that allows reading key until ttl has passed.
+	Presign(key string, ttl time.Duration) (string, error)
+}
+
+// storageFromEnv returns the driver selected by STORAGE_DRIVER: "s3" (the
+// default) or "local", which writes under LOCAL_STORAGE_DIR for the backend
+// to serve during development.
+func storageFromEnv() (Storage, error) {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "s3":
+		sess, err := createAWSSession()
+		if err != nil {
+			return nil, err
+		}
+		return newS3Storage(sess, os.Getenv("S3_BUCKET_NAME")), nil
+	case "local":
+		return newLocalStorage(envString("LOCAL_STORAGE_DIR", defaultLocalStorageDir),
+			envString("MEDIA_BASE_URL", "http://localhost:8080/media"))
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+}
+
+func createAWSSession() (*session.Session, error) {
+	awsRegion := os.Getenv("AWS_REGION")
+	if awsRegion == "" {
+		return nil, fmt.Errorf("AWS_REGION environment variable not set")
+	}
+	return session.NewSession(&aws.Config{
+		Region: aws.String(awsRegion),
+	})
+}
+
+// S3Storage stores objects in an S3 bucket, using multipart uploads for
+// large files.
+type S3Storage struct {
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func newS3Storage(sess *session.Session, bucket string) *S3Storage {
+	return &S3Storage{svc: s3.New(sess), uploader: s3manager.NewUploader(sess), bucket: bucket}
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.CacheControl != "" {
+		input.CacheControl = aws.String(opts.CacheControl)
+	}
+	_, err := s.uploader.UploadWithContext(ctx, input)
+	return err
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	return keys, err
+}
+
+// DeletePrefix deletes every object under prefix, a page at a time.
+func (s *S3Storage) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	deleted := 0
+	var deleteErr error
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: obj.Key})
+		}
+		_, deleteErr = s.svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if deleteErr != nil {
+			return false
+		}
+		deleted += len(objects)
+		return true
+	})
+	if err == nil {
+		err = deleteErr
+	}
+	return deleted, err
+}
+
+func (s *S3Storage) Presign(key string, ttl time.Duration) (string, error) {
+	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
+}
+
+// LocalStorage stores objects as files under a root directory, for
+// development. Keys map directly to paths, so the Put options are not kept;
+// the backend's file server derives headers from the extension.
+type LocalStorage struct {
+	root    string
+	baseURL string
+}
+
+func newLocalStorage(root, baseURL string) (*LocalStorage, error) {
+	root = filepath.Clean(root)
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &LocalStorage{root: root, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// path maps a key to its file, rejecting keys that escape the root.
+func (l *LocalStorage) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(clean)), nil
+}
+
+func (l *LocalStorage) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial object.
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes the file private; the file server needs to read it.
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (l *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	return f, err
+}
+
+func (l *LocalStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	// Walk the deepest directory the prefix names, then filter by prefix.
+	dir := path.Dir(path.Clean("/" + prefix))
+	if strings.HasSuffix(prefix, "/") {
+		dir = path.Clean("/" + prefix)
+	}
+	var keys []string
+	err := filepath.WalkDir(filepath.Join(l.root, filepath.FromSlash(dir)), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return err
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return ctx.Err()
+	})
+	return keys, err
+}
+
+func (l *LocalStorage) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	keys, err := l.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, key := range keys {
+		p, err := l.path(key)
+		if err != nil {
+			return deleted, err
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return deleted, err
+		}
+		deleted++
+		// Remove directories left empty, up to the root.
+		for dir := filepath.Dir(p); dir != l.root && strings.HasPrefix(dir, l.root); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// Presign returns the object's plain URL: the development file server does
+// not check access, so there is nothing to sign.
+func (l *LocalStorage) Presign(key string, ttl time.Duration) (string, error) {
+	return l.baseURL + "/" + strings.TrimPrefix(key, "/"), nil
+}
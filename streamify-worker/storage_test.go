@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocalStorage(t *testing.T, keys ...string) *LocalStorage {
+	t.Helper()
+	l, err := newLocalStorage(t.TempDir(), "http://localhost:8080/media/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := l.Put(context.Background(), key, strings.NewReader(key), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l
+}
+
+func TestLocalStoragePutGet(t *testing.T) {
+	l := newTestLocalStorage(t, "videos/1/master.m3u8")
+	r, err := l.Get(context.Background(), "videos/1/master.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := io.ReadAll(r); string(data) != "videos/1/master.m3u8" {
+		t.Errorf("Get() = %q, want the stored content", data)
+	}
+	if _, err := l.Get(context.Background(), "videos/1/missing.ts"); err != errObjectNotFound {
+		t.Errorf("Get() of a missing key error = %v, want errObjectNotFound", err)
+	}
+	if err := l.Put(context.Background(), "../escape", strings.NewReader("x"), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(l.root, "escape")); err != nil {
+		t.Errorf("key escaping the root was not kept inside it: %v", err)
+	}
+}
+
+func TestLocalStorageList(t *testing.T) {
+	l := newTestLocalStorage(t, "videos/1/master.m3u8", "videos/1/720p/segment0.ts", "videos/12/master.m3u8", "videos/2/master.m3u8")
+	// A Put still in progress.
+	if err := os.WriteFile(filepath.Join(l.root, "videos/1/.upload-123"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"videos/1/", []string{"videos/1/720p/segment0.ts", "videos/1/master.m3u8"}},
+		{"videos/1", []string{"videos/1/720p/segment0.ts", "videos/1/master.m3u8", "videos/12/master.m3u8"}},
+		{"videos/1/master", []string{"videos/1/master.m3u8"}},
+		{"videos/3/", nil},
+	}
+	for _, tt := range tests {
+		got, err := l.List(context.Background(), tt.prefix)
+		if err != nil {
+			t.Fatalf("List(%q) error = %v", tt.prefix, err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestLocalStorageDeletePrefix(t *testing.T) {
+	l := newTestLocalStorage(t, "videos/1/master.m3u8", "videos/1/720p/segment0.ts", "videos/12/master.m3u8")
+	n, err := l.DeletePrefix(context.Background(), "videos/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("DeletePrefix() = %d, want 2", n)
+	}
+	if _, err := os.Stat(filepath.Join(l.root, "videos/1")); !os.IsNotExist(err) {
+		t.Error("empty directories were left behind")
+	}
+	if keys, _ := l.List(context.Background(), "videos/"); !reflect.DeepEqual(keys, []string{"videos/12/master.m3u8"}) {
+		t.Errorf("remaining keys = %v, want only video 12", keys)
+	}
+}
+
+func TestLocalStoragePresign(t *testing.T) {
+	l := newTestLocalStorage(t)
+	got, err := l.Presign("videos/1/master.m3u8", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://localhost:8080/media/videos/1/master.m3u8"; got != want {
+		t.Errorf("Presign() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var (
+	errFFmpegTimeout = errors.New("ffmpeg exceeded its time limit")
+	errFFmpegStalled = errors.New("ffmpeg stopped making progress")
+)
+
+// ProcessLimits supervises the ffmpeg and ffprobe processes.
+type ProcessLimits struct {
+	// The time limit is TimeoutFactor times the source duration, clamped to
+	// [MinTimeout, MaxTimeout]. Sources of unknown duration get MaxTimeout.
+	TimeoutFactor float64
+	MinTimeout    time.Duration
+	MaxTimeout    time.Duration
+	// StallTimeout kills ffmpeg when its output position stops advancing.
+	StallTimeout time.Duration
+	// MaxMemoryMB caps ffmpeg's data segment; zero means no cap.
+	MaxMemoryMB int
+	// Threads caps encoder threads; zero lets ffmpeg pick.
+	Threads int
+	// Nice lowers ffmpeg's CPU priority so it cannot starve the worker.
+	Nice int
+}
+
+func processLimitsFromEnv() ProcessLimits {
+	l := ProcessLimits{
+		TimeoutFactor: float64(envInt("FFMPEG_TIMEOUT_FACTOR", 10)),
+		MinTimeout:    envDuration("FFMPEG_MIN_TIMEOUT", 10*time.Minute),
+		MaxTimeout:    envDuration("FFMPEG_MAX_TIMEOUT", 6*time.Hour),
+		StallTimeout:  envDuration("FFMPEG_STALL_TIMEOUT", 2*time.Minute),
+		MaxMemoryMB:   envInt("FFMPEG_MAX_MEMORY_MB", 0),
+		Threads:       envInt("FFMPEG_THREADS", 0),
+		Nice:          envInt("FFMPEG_NICE", 10),
+	}
+	if l.MaxTimeout < l.MinTimeout {
+		l.MaxTimeout = l.MinTimeout
+	}
+	return l
+}
+
+func (l ProcessLimits) timeoutFor(duration time.Duration) time.Duration {
+	if duration <= 0 {
+		return l.MaxTimeout
+	}
+	t := time.Duration(float64(duration) * l.TimeoutFactor)
+	if t < l.MinTimeout {
+		return l.MinTimeout
+	}
+	if t > l.MaxTimeout {
+		return l.MaxTimeout
+	}
+	return t
+}
+
+// command builds a supervised ffmpeg or ffprobe command. nice and prlimit
+// exec into the tool, so the limits apply to its process itself.
+func (l ProcessLimits) command(ctx context.Context, name string, args []string) *exec.Cmd {
+	if name == "ffmpeg" && l.Threads > 0 && len(args) > 0 {
+		// Output options go right before the output path, the last argument.
+		out := args[len(args)-1]
+		args = append(args[:len(args)-1:len(args)-1], "-threads", strconv.Itoa(l.Threads), out)
+	}
+	argv := append([]string{name}, args...)
+	if l.MaxMemoryMB > 0 {
+		argv = append([]string{"prlimit", "--data=" + strconv.Itoa(l.MaxMemoryMB<<20), "--"}, argv...)
+	}
+	if l.Nice != 0 {
+		argv = append([]string{"nice", "-n", strconv.Itoa(l.Nice)}, argv...)
+	}
+	return supervisedCommand(ctx, argv[0], argv[1:]...)
+}
+
+// ffmpegRunner runs ffmpeg and ffprobe under ProcessLimits. It is shared by
+// the ffmpeg transcoder and the worker, and slots bounds the number of
+// ffmpeg processes across all jobs.
+type ffmpegRunner struct {
+	process ProcessLimits
+	slots   semaphore
+}
+
+// quiet runs ffmpeg on a source of the given duration, killing it after the
+// same time limit a transcode of that source gets.
+func (r *ffmpegRunner) quiet(ctx context.Context, duration time.Duration, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.process.timeoutFor(duration))
+	defer cancel()
+	cmd := r.process.command(ctx, "ffmpeg", append([]string{"-v", "error"}, args...))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// supervisedCommand is exec.CommandContext, except that the process runs in
+// its own process group and cancelling ctx kills the whole group.
+func supervisedCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Do not wait forever on pipes held open by a stuck process.
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
+
+// stallTimer calls onStall when the ffmpeg output position has not advanced
+// for timeout. A zero timeout disables it.
+type stallTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+	last    time.Duration
+}
+
+func newStallTimer(timeout time.Duration, onStall func()) *stallTimer {
+	t := &stallTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, onStall)
+	}
+	return t
+}
+
+func (t *stallTimer) advance(outTime time.Duration) {
+	if t.timer == nil || outTime <= t.last {
+		return
+	}
+	t.last = outTime
+	t.timer.Reset(t.timeout)
+}
+
+func (t *stallTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
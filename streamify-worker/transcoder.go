@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TranscodeSpec describes one transcode: which renditions of the source to
+// write into OutputDir and how to package them.
+type TranscodeSpec struct {
+	InputPath  string
+	OutputDir  string
+	Source     SourceInfo
+	Renditions []Rendition
+	Profile    EncodingProfile
+	Format     string
+	// KeyInfoFile, when set, encrypts HLS segments with AES-128.
+	KeyInfoFile string
+	// Overlay is burned into the watermarked renditions.
+	Overlay Overlay
+}
+
+// TranscodeOutput lists the files a transcode wrote, relative to OutputDir.
+type TranscodeOutput struct {
+	Files []string
+}
+
+// Transcoder does the media work of a job. The ffmpeg driver is used in
+// production; the fake driver writes synthetic output so the rest of the
+// pipeline can run without ffmpeg.
+type Transcoder interface {
+	Probe(ctx context.Context, inputPath string) (SourceInfo, error)
+	// Transcode writes the media playlists and segments of every rendition.
+	// progress receives the percentage complete, 0-100. The master playlist
+	// is not written; the worker builds it from the spec.
+	Transcode(ctx context.Context, spec TranscodeSpec, progress func(percent float64)) (TranscodeOutput, error)
+	// Images writes the poster, thumbnails and storyboard into outputDir,
+	// with the overlay drawn on them.
+	Images(ctx context.Context, inputPath, outputDir string, src SourceInfo, overlay Overlay) (VideoImages, error)
+}
+
+// transcoderFromEnv returns the driver selected by TRANSCODER: "ffmpeg" (the
+// default) or "fake".
+func transcoderFromEnv(ffmpeg *ffmpegRunner) (Transcoder, error) {
+	switch driver := os.Getenv("TRANSCODER"); driver {
+	case "", "ffmpeg":
+		return &FFmpegTranscoder{ffmpeg: ffmpeg}, nil
+	case "fake":
+		return &FakeTranscoder{Duration: envDuration("FAKE_TRANSCODE_DURATION", 0)}, nil
+	default:
+		return nil, fmt.Errorf("unknown TRANSCODER %q", driver)
+	}
+}
+
+// FFmpegTranscoder runs ffprobe and ffmpeg, with at most one encode per slot.
+type FFmpegTranscoder struct {
+	ffmpeg *ffmpegRunner
+}
+
+func (t *FFmpegTranscoder) Probe(ctx context.Context, inputPath string) (SourceInfo, error) {
+	return probeSource(ctx, t.ffmpeg.process, inputPath)
+}
+
+func (t *FFmpegTranscoder) Transcode(ctx context.Context, spec TranscodeSpec, progress func(percent float64)) (TranscodeOutput, error) {
+	args := ladderArgs(spec.InputPath, spec.OutputDir, spec.Renditions, spec.Profile, spec.Source, spec.Format, spec.KeyInfoFile, spec.Overlay)
+	if err := t.run(ctx, args, spec.Source.Duration, progress); err != nil {
+		return TranscodeOutput{}, err
+	}
+	files, err := listFiles(spec.OutputDir)
+	if err != nil {
+		return TranscodeOutput{}, retryableError("could not list transcoder output", err)
+	}
+	return TranscodeOutput{Files: files}, nil
+}
+
+func (t *FFmpegTranscoder) Images(ctx context.Context, inputPath, outputDir string, src SourceInfo, overlay Overlay) (VideoImages, error) {
+	return generateImages(ctx, t.ffmpeg, inputPath, outputDir, src, overlay)
+}
+
+// run runs one ffmpeg invocation under the ffmpeg concurrency limit and
+// reports progress against the source duration. The process is killed when
+// it outlives the time limit for the source duration or stops making
+// progress.
+func (t *FFmpegTranscoder) run(ctx context.Context, args []string, duration time.Duration, progress func(percent float64)) error {
+	if err := t.ffmpeg.slots.acquire(ctx); err != nil {
+		return err
+	}
+	defer t.ffmpeg.slots.release()
+
+	parent := ctx
+	timeout := t.ffmpeg.process.timeoutFor(duration)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	ctx, cancelTimeout := context.WithTimeoutCause(ctx, timeout, errFFmpegTimeout)
+	defer cancelTimeout()
+
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd := t.ffmpeg.process.command(ctx, "ffmpeg", args)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return retryableError("could not start ffmpeg", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return retryableError("could not start ffmpeg", err)
+	}
+	stall := newStallTimer(t.ffmpeg.process.StallTimeout, func() { cancel(errFFmpegStalled) })
+	defer stall.stop()
+	readFFmpegProgress(stdout, func(outTime time.Duration) {
+		stall.advance(outTime)
+		if duration > 0 {
+			progress(float64(outTime) / float64(duration) * 100)
+		}
+	})
+	if err := cmd.Wait(); err != nil {
+		if parent.Err() == nil {
+			switch cause := context.Cause(ctx); {
+			case errors.Is(cause, errFFmpegTimeout):
+				return retryableError(fmt.Sprintf("transcoding timed out after %s", timeout), cause)
+			case errors.Is(cause, errFFmpegStalled):
+				return retryableError(fmt.Sprintf("transcoding stalled with no progress for %s", t.ffmpeg.process.StallTimeout), cause)
+			}
+		}
+		return ffmpegError("transcoding failed", err, stderr.String())
+	}
+	return nil
+}
+
+// listFiles returns the paths of the files under dir, relative to dir.
+func listFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	return files, err
+}
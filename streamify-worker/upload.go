@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadManifestTTL keeps the record of uploaded objects long enough to cover
+// every retry of a job.
+const uploadManifestTTL = 7 * 24 * time.Hour
+
+// uploadManifestKey is a Redis hash mapping each storage key uploaded for the
+// video to the MD5 of its content. A retried job skips files whose content is
+// already in storage.
+func uploadManifestKey(videoID int) string {
+	return fmt.Sprintf("upload_manifest:%d", videoID)
+}
+
+const (
+	cacheImmutable = "public, max-age=31536000, immutable"
+	cacheManifest  = "public, max-age=60"
+	cacheImage     = "public, max-age=86400"
+)
+
+type objectType struct {
+	ContentType  string
+	CacheControl string
+}
+
+// objectTypes maps output file extensions to their response headers. Segments
+// never change once published; playlists can be rewritten, for example when
+// captions are added.
+var objectTypes = map[string]objectType{
+	".m3u8": {"application/vnd.apple.mpegurl", cacheManifest},
+	".mpd":  {"application/dash+xml", cacheManifest},
+	".ts":   {"video/mp2t", cacheImmutable},
+	".m4s":  {"video/iso.segment", cacheImmutable},
+	".mp4":  {"video/mp4", cacheImmutable},
+	".vtt":  {"text/vtt; charset=utf-8", cacheManifest},
+	".jpg":  {"image/jpeg", cacheImage},
+	".jpeg": {"image/jpeg", cacheImage},
+	".png":  {"image/png", cacheImage},
+	".webp": {"image/webp", cacheImage},
+}
+
+func objectTypeFor(name string) objectType {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := objectTypes[ext]; ok {
+		return t
+	}
+	return objectType{ContentType: mime.TypeByExtension(ext)}
+}
+
+// UploadPolicy controls per-object retries during the upload stage.
+type UploadPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+}
+
+func uploadPolicyFromEnv() UploadPolicy {
+	p := UploadPolicy{
+		MaxAttempts: envInt("UPLOAD_MAX_ATTEMPTS", 4),
+		BaseDelay:   envDuration("UPLOAD_RETRY_BASE_DELAY", time.Second),
+	}
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	return p
+}
+
+// putFile stores a file with the headers for its type.
+func (w *Worker) putFile(ctx context.Context, filePath string, key string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	t := objectTypeFor(key)
+	return w.storage.Put(ctx, key, file, PutOptions{ContentType: t.ContentType, CacheControl: t.CacheControl})
+}
+
+// uploadWithRetry uploads one file, retrying failures with jittered
+// exponential backoff.
+func (w *Worker) uploadWithRetry(ctx context.Context, filePath, key string) error {
+	var err error
+	delay := w.upload.BaseDelay
+	for attempt := 1; ; attempt++ {
+		if err = w.putFile(ctx, filePath, key); err == nil {
+			return nil
+		}
+		if attempt == w.upload.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// uploadOutput uploads every file under outputDir to keyPrefix in parallel,
+// bounded by the worker's upload limit. Files recorded in the video's
+// upload manifest with the same content are skipped. A failed file does not
+// stop the others, so a retry only has to upload what is still missing.
+func (w *Worker) uploadOutput(ctx context.Context, videoID int, outputDir, keyPrefix string, progress *progressReporter) error {
+	var files []string
+	err := filepath.Walk(outputDir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	manifestKey := uploadManifestKey(videoID)
+	uploaded, err := w.rdb.HGetAll(ctx, manifestKey).Result()
+	if err != nil {
+		log.Printf("⚠️ Could not read upload manifest for video ID %d, uploading everything: %v", videoID, err)
+		uploaded = map[string]string{}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		done     int
+		skipped  int
+		failed   int
+		firstErr error
+	)
+	finish := func(rel string, skip bool, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.Printf("❌ Failed to upload %s: %v", rel, err)
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		if skip {
+			skipped++
+		}
+		done++
+		progress.Update(float64(done) / float64(len(files)) * 100)
+	}
+
+	for _, p := range files {
+		rel, err := filepath.Rel(outputDir, p)
+		if err != nil {
+			return err
+		}
+		key := path.Join(keyPrefix, filepath.ToSlash(rel))
+		if err := w.uploads.acquire(ctx); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer w.uploads.release()
+			sum, err := fileMD5(p)
+			if err != nil {
+				finish(rel, false, err)
+				return
+			}
+			if uploaded[key] == sum {
+				finish(rel, true, nil)
+				return
+			}
+			if err := w.uploadWithRetry(ctx, p, key); err != nil {
+				finish(rel, false, err)
+				return
+			}
+			// A lost manifest entry only costs a re-upload on retry.
+			if err := w.rdb.HSet(ctx, manifestKey, key, sum).Err(); err == nil {
+				w.rdb.Expire(ctx, manifestKey, uploadManifestTTL)
+			}
+			finish(rel, false, nil)
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to upload: %w", failed, len(files), firstErr)
+	}
+	if skipped > 0 {
+		log.Printf("⏭️ Skipped %d files already uploaded for video ID %d", skipped, videoID)
+	}
+	return nil
+}
+
+func fileMD5(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
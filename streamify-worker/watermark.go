@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// watermarkPositions maps the backend's positions to overlay coordinates,
+// given the margin in pixels.
+var watermarkPositions = map[string]func(margin int) string{
+	"top-left":     func(m int) string { return fmt.Sprintf("x=%[1]d:y=%[1]d", m) },
+	"top-right":    func(m int) string { return fmt.Sprintf("x=W-w-%[1]d:y=%[1]d", m) },
+	"bottom-left":  func(m int) string { return fmt.Sprintf("x=%[1]d:y=H-h-%[1]d", m) },
+	"bottom-right": func(m int) string { return fmt.Sprintf("x=W-w-%[1]d:y=H-h-%[1]d", m) },
+	"center":       func(int) string { return "x=(W-w)/2:y=(H-h)/2" },
+}
+
+// overlayFallbackWidth sizes the watermark when the source width is unknown.
+const overlayFallbackWidth = 1280
+
+// errCMAFWatermark rejects watermarked CMAF jobs: the DASH manifest would list
+// the preview renditions next to the clean ones.
+var errCMAFWatermark = errors.New("CMAF output cannot keep previews apart")
+
+// Watermark is an organization's watermark image and where to place it.
+// Scale and Margin are fractions of the video width.
+type Watermark struct {
+	Image    []byte
+	Position string
+	Scale    float64
+	Opacity  float64
+	Margin   float64
+}
+
+// Overlay is what a transcode burns into the video: a watermark image, a text
+// overlay read from TextFile, or both.
+type Overlay struct {
+	ImagePath string
+	Position  string
+	Scale     float64
+	Opacity   float64
+	Margin    float64
+	TextFile  string
+}
+
+func (o Overlay) empty() bool {
+	return o.ImagePath == "" && o.TextFile == ""
+}
+
+// loadWatermark returns the watermark of the user's organization, or nil if
+// it has none.
+func loadWatermark(db *sql.DB, userID int) (*Watermark, error) {
+	var wm Watermark
+	query := `
+	SELECT w.image, w.position, w.scale, w.opacity, w.margin
+	FROM watermarks w JOIN users u ON u.org_id = w.org_id WHERE u.id = $1`
+	err := db.QueryRow(query, userID).Scan(&wm.Image, &wm.Position, &wm.Scale, &wm.Opacity, &wm.Margin)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wm, nil
+}
+
+// prepareOverlay writes the watermark image and text into dir for ffmpeg.
+// Either may be absent.
+func prepareOverlay(dir string, wm *Watermark, text string) (Overlay, error) {
+	var o Overlay
+	if wm != nil {
+		o = Overlay{
+			ImagePath: filepath.Join(dir, "watermark.png"),
+			Position:  wm.Position,
+			Scale:     wm.Scale,
+			Opacity:   wm.Opacity,
+			Margin:    wm.Margin,
+		}
+		if err := os.WriteFile(o.ImagePath, wm.Image, 0o600); err != nil {
+			return Overlay{}, err
+		}
+	}
+	if text != "" {
+		// A text file avoids escaping the text for the filter graph.
+		o.TextFile = filepath.Join(dir, "watermark.txt")
+		if err := os.WriteFile(o.TextFile, []byte(text), 0o600); err != nil {
+			return Overlay{}, err
+		}
+	}
+	return o, nil
+}
+
+// filter returns the filter graph chain that draws the overlay onto the
+// video labelled in, labelled out. The image is input 1. The text drifts
+// slowly around the frame so it cannot simply be cropped out.
+func (o Overlay) filter(srcWidth int, in, out string) string {
+	if srcWidth <= 0 {
+		srcWidth = overlayFallbackWidth
+	}
+	var chains []string
+	video := in
+	if o.ImagePath != "" {
+		position, ok := watermarkPositions[o.Position]
+		if !ok {
+			position = watermarkPositions["bottom-right"]
+		}
+		width := evenDimension(int(o.Scale * float64(srcWidth)))
+		if width < 2 {
+			width = 2
+		}
+		margin := int(o.Margin * float64(srcWidth))
+		chains = append(chains,
+			fmt.Sprintf("[1:v]format=rgba,colorchannelmixer=aa=%.2f,scale=w=%d:h=-1[logo]", o.Opacity, width),
+			video+"[logo]overlay="+position(margin)+"[logoed]",
+		)
+		video = "[logoed]"
+	}
+	if o.TextFile != "" {
+		chains = append(chains, fmt.Sprintf(
+			"%sdrawtext=textfile='%s':expansion=none:fontsize=h/30:fontcolor=white@0.4:borderw=1:bordercolor=black@0.3:"+
+				"x=(w-tw)*abs(sin(t/23)):y=(h-th)*abs(sin(t/37))[texted]",
+			video, strings.ReplaceAll(o.TextFile, "'", `'\''`)))
+		video = "[texted]"
+	}
+	chains = append(chains, video+"null"+out)
+	return strings.Join(chains, ";")
+}
+
+// filterArgs returns the ffmpeg arguments, after the source input, that
+// apply chain to input 0 with the overlay drawn on first.
+func (o Overlay) filterArgs(srcWidth int, chain string) []string {
+	if o.empty() {
+		return []string{"-vf", chain}
+	}
+	var args []string
+	if o.ImagePath != "" {
+		args = append(args, "-i", o.ImagePath)
+	}
+	return append(args, "-filter_complex", o.filter(srcWidth, "[0:v]", "[marked]")+";[marked]"+chain)
+}
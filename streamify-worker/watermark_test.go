@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOverlayFilterPositions(t *testing.T) {
+	tests := []struct {
+		position string
+		want     string
+	}{
+		{"top-left", "[0:v][logo]overlay=x=24:y=24[logoed]"},
+		{"top-right", "[0:v][logo]overlay=x=W-w-24:y=24[logoed]"},
+		{"bottom-left", "[0:v][logo]overlay=x=24:y=H-h-24[logoed]"},
+		{"bottom-right", "[0:v][logo]overlay=x=W-w-24:y=H-h-24[logoed]"},
+		{"center", "[0:v][logo]overlay=x=(W-w)/2:y=(H-h)/2[logoed]"},
+		{"unknown", "[0:v][logo]overlay=x=W-w-24:y=H-h-24[logoed]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.position, func(t *testing.T) {
+			o := Overlay{ImagePath: "/tmp/wm.png", Position: tt.position, Scale: 0.15, Opacity: 0.8, Margin: 0.02}
+			got := o.filter(1200, "[0:v]", "[marked]")
+			want := strings.Join([]string{
+				"[1:v]format=rgba,colorchannelmixer=aa=0.80,scale=w=180:h=-1[logo]",
+				tt.want,
+				"[logoed]null[marked]",
+			}, ";")
+			if got != want {
+				t.Errorf("filter() =\n  %s\nwant\n  %s", got, want)
+			}
+			if strings.Contains(got, "%!") {
+				t.Errorf("filter() has a formatting error: %s", got)
+			}
+		})
+	}
+}
+
+func TestOverlayFilterText(t *testing.T) {
+	o := Overlay{TextFile: "/tmp/it's.txt"}
+	got := o.filter(0, "[0:v]", "[marked]")
+	if !strings.HasPrefix(got, `[0:v]drawtext=textfile='/tmp/it'\''s.txt':expansion=none:`) {
+		t.Errorf("filter() = %s, want drawtext reading the quoted text file", got)
+	}
+	if !strings.HasSuffix(got, "[texted];[texted]null[marked]") {
+		t.Errorf("filter() = %s, want the text chain labelled [marked]", got)
+	}
+}
+
+func TestOverlayFilterImageAndText(t *testing.T) {
+	o := Overlay{ImagePath: "/tmp/wm.png", Position: "top-left", Scale: 0.1, Opacity: 1, TextFile: "/tmp/wm.txt"}
+	got := o.filter(1920, "[0:v]", "[marked]")
+	if !strings.Contains(got, "[logoed]drawtext=") {
+		t.Errorf("filter() = %s, want the text drawn over the watermarked video", got)
+	}
+}
+
+func TestLadderArgsWatermarksPreviewsOnly(t *testing.T) {
+	src := SourceInfo{Width: 1280, Height: 720}
+	renditions := buildLadder(src, lookupProfile("standard"))
+	renditions = append(renditions, previewLadder(renditions, []string{"360p"})...)
+	overlay := Overlay{TextFile: "/tmp/wm.txt"}
+	args := ladderArgs("in.mp4", "out", renditions, lookupProfile("standard"), src, FormatHLS, "", overlay)
+
+	var filter string
+	for i, a := range args {
+		if a == "-filter_complex" {
+			filter = args[i+1]
+		}
+	}
+	for _, want := range []string{"[0:v]split=2[clean][unmarked];[unmarked]drawtext=", "[clean]split=3[v0][v1][v2];", "[marked]split=1[v3]"} {
+		if !strings.Contains(filter, want) {
+			t.Errorf("filter graph = %s, want it to contain %s", filter, want)
+		}
+	}
+	if got := renditions[3]; got.Name != "360p_wm" || !got.Watermarked {
+		t.Errorf("preview rendition = %+v, want a watermarked 360p_wm", got)
+	}
+}
+
+func TestPreviewLadderFallsBackToSmallest(t *testing.T) {
+	renditions := []Rendition{{Name: "240p", Height: 240}}
+	got := previewLadder(renditions, []string{"1080p"})
+	if len(got) != 1 || got[0].Name != "240p_wm" {
+		t.Errorf("previewLadder() = %+v, want a copy of the 240p rendition", got)
+	}
+}
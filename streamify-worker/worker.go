@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// jobLockTTL bounds how long a crashed worker can keep a video locked.
+const jobLockTTL = 6 * time.Hour
+
+// maxCaptionLockWaits bounds how often a captions job waits for a locked
+// video. With the default retry policy the waits outlast jobLockTTL.
+const maxCaptionLockWaits = 20
+
+var errVideoLocked = errors.New("video stayed locked by another job")
+
+type Worker struct {
+	db      *sql.DB
+	rdb     *redis.Client
+	queue   *Queue
+	retry   RetryPolicy
+	limits  Limits
+	uploads semaphore
+	storage Storage
+	// transcoder probes, encodes and extracts images from sources.
+	transcoder Transcoder
+	// ffmpeg runs the worker's own ffmpeg commands, such as subtitle
+	// extraction, under the transcoder's limits.
+	ffmpeg *ffmpegRunner
+	// scratchDir holds one temporary directory per running job and is removed
+	// when the worker exits.
+	scratchDir string
+	// scanner is nil when malware scanning is disabled.
+	scanner *ClamdScanner
+	// contentKeys is nil when HLS encryption is disabled.
+	contentKeys *ContentKeys
+	cancels     *cancellations
+	upload      UploadPolicy
+}
+
+// uploadsDir is the uploads volume shared with the backend.
+var uploadsDir = "/app/uploads"
+
+// sourcePath is where the backend leaves a job's source file on the shared
+// uploads volume, keyed by video ID like the backend's SourcePath.
+func sourcePath(job VideoJob) string {
+	return filepath.Join(uploadsDir, fmt.Sprintf("%d-%s", job.VideoID, job.Filename))
+}
+
+// errJobInterrupted is returned by handleJob when the worker shut down before
+// the job finished; the job should go back on the queue untouched.
+var errJobInterrupted = errors.New("job interrupted by shutdown")
+
+// handleJob processes a job at most once per video. Jobs are delivered
+// at-least-once by the backend's outbox relay, so a duplicate delivery for a
+// video that is already being processed, or is no longer processing, is
+// acknowledged and dropped. Cancelling ctx aborts the job and returns
+// errJobInterrupted; deleting the video aborts it and cleans up its output.
+func (w *Worker) handleJob(ctx context.Context, job VideoJob) error {
+	if job.Task == TaskCaptions {
+		return w.handleCaptionsJob(ctx, job)
+	}
+	bg := context.WithoutCancel(ctx)
+	acquired, err := w.rdb.SetNX(bg, jobLockKey(job.VideoID), w.queue.WorkerID(), jobLockTTL).Result()
+	if err != nil {
+		w.finishJob(bg, job, retryableError("could not lock video", err))
+		return nil
+	}
+	if !acquired {
+		log.Printf("⏭️ Skipping duplicate job for video ID %d: already in progress", job.VideoID)
+		return nil
+	}
+	defer w.queue.releaseLockIfOwner(bg, job.VideoID, w.queue.WorkerID())
+
+	var status string
+	err = w.db.QueryRow("SELECT status FROM videos WHERE id = $1", job.VideoID).Scan(&status)
+	if err == sql.ErrNoRows {
+		log.Printf("⏭️ Skipping job for video ID %d: video no longer exists", job.VideoID)
+		w.cleanupDeletedVideo(bg, job)
+		return nil
+	}
+	if err != nil {
+		w.finishJob(bg, job, retryableError("could not look up video", err))
+		return nil
+	}
+	if status != "processing" {
+		log.Printf("⏭️ Skipping duplicate job for video ID %d: status is %s", job.VideoID, status)
+		return nil
+	}
+
+	jobCtx, done := w.cancels.register(ctx, job.VideoID)
+	err = w.processJob(jobCtx, job)
+	done()
+	if context.Cause(jobCtx) == errVideoDeleted || errors.Is(err, errVideoDeleted) {
+		log.Printf("🛑 Job for video ID %d stopped: video was deleted", job.VideoID)
+		w.cleanupDeletedVideo(bg, job)
+		return nil
+	}
+	if err != nil && ctx.Err() != nil {
+		log.Printf("🛑 Job for video ID %d interrupted: %v", job.VideoID, err)
+		return errJobInterrupted
+	}
+	w.finishJob(bg, job, err)
+	return nil
+}
+
+// finishJob settles a job after an attempt: retryable failures are scheduled
+// again with backoff until the retry policy is exhausted, at which point the
+// job is dead-lettered. The source file is only removed once the video has
+// reached a terminal status.
+func (w *Worker) finishJob(ctx context.Context, job VideoJob, err error) {
+	inputPath := sourcePath(job)
+	if err == nil {
+		os.Remove(inputPath)
+		return
+	}
+
+	jobErr := classifyError(err)
+	log.Printf("❌ Job for video ID %d failed (attempt %d): %v", job.VideoID, job.Attempt+1, err)
+
+	if jobErr.Retryable {
+		if job.Attempt+1 < w.retry.MaxAttempts {
+			delay := w.retry.Backoff(job.Attempt + 1)
+			retry := job
+			retry.Attempt++
+			retry.LastError = err.Error()
+			schedErr := w.queue.Schedule(ctx, retry, delay)
+			if schedErr == nil {
+				log.Printf("🔁 Retrying video ID %d in %s", job.VideoID, delay.Round(time.Second))
+				return
+			}
+			log.Printf("❌ Failed to schedule retry for video ID %d: %v", job.VideoID, schedErr)
+		}
+		if dlqErr := w.queue.DeadLetter(ctx, job, err); dlqErr != nil {
+			log.Printf("❌ Failed to dead-letter job for video ID %d: %v", job.VideoID, dlqErr)
+		} else {
+			log.Printf("🪦 Moved job for video ID %d to %s", job.VideoID, deadLetterQueue)
+		}
+		// The source is kept so the dead-lettered job can be replayed.
+		if statusErr := setVideoStatusReason(w.db, job.VideoID, jobErr.Status, jobErr.Reason); statusErr != nil {
+			log.Printf("❌ Failed to update status for video ID %d: %v", job.VideoID, statusErr)
+		}
+		return
+	}
+
+	if statusErr := setVideoStatusReason(w.db, job.VideoID, jobErr.Status, jobErr.Reason); statusErr != nil {
+		log.Printf("❌ Failed to update status for video ID %d: %v", job.VideoID, statusErr)
+	}
+	os.Remove(inputPath)
+}
+
+// handleCaptionsJob publishes a video's caption tracks. A transcode holding
+// the video's lock will include them itself, but may have loaded the tracks
+// before this job was queued, so the job waits for the lock instead of being
+// dropped. It backs off between checks and is dead-lettered if the lock is
+// still held after maxCaptionLockWaits.
+func (w *Worker) handleCaptionsJob(ctx context.Context, job VideoJob) error {
+	bg := context.WithoutCancel(ctx)
+	locked, err := w.rdb.SetNX(bg, jobLockKey(job.VideoID), w.queue.WorkerID(), jobLockTTL).Result()
+	if err != nil || !locked {
+		if job.LockWaits >= maxCaptionLockWaits {
+			if err := w.queue.DeadLetter(bg, job, errVideoLocked); err != nil {
+				log.Printf("❌ Failed to dead-letter captions job for video ID %d: %v", job.VideoID, err)
+			}
+			return nil
+		}
+		wait := job
+		wait.LockWaits++
+		if err := w.queue.Schedule(bg, wait, w.retry.Backoff(wait.LockWaits)); err != nil {
+			log.Printf("❌ Failed to reschedule captions for video ID %d: %v", job.VideoID, err)
+		}
+		return nil
+	}
+	defer w.queue.releaseLockIfOwner(bg, job.VideoID, w.queue.WorkerID())
+
+	err = w.publishCaptions(ctx, job)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return errJobInterrupted
+	}
+	log.Printf("❌ Captions job for video ID %d failed (attempt %d): %v", job.VideoID, job.Attempt+1, err)
+	// The video itself is unaffected, so failures never change its status.
+	if classifyError(err).Retryable && job.Attempt+1 < w.retry.MaxAttempts {
+		retry := job
+		retry.Attempt++
+		retry.LastError = err.Error()
+		if err := w.queue.Schedule(bg, retry, w.retry.Backoff(retry.Attempt)); err == nil {
+			return nil
+		}
+	}
+	if err := w.queue.DeadLetter(bg, job, err); err != nil {
+		log.Printf("❌ Failed to dead-letter captions job for video ID %d: %v", job.VideoID, err)
+	}
+	return nil
+}
+
+func (w *Worker) processJob(ctx context.Context, job VideoJob) error {
+	log.Printf("📥 Received job for video ID %d: %s (profile %s)", job.VideoID, job.Filename, job.Profile)
+
+	inputPath := sourcePath(job)
+	s3KeyPrefix := fmt.Sprintf("videos/%d/%s", job.VideoID, job.Filename)
+	// Each job gets its own scratch directory so concurrent jobs never collide.
+	outputDir, err := os.MkdirTemp(w.scratchDir, fmt.Sprintf("video-%d-*", job.VideoID))
+	if err != nil {
+		return retryableError("could not create scratch directory", err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	progress := newProgressReporter(w.db, job.VideoID)
+	if job.SourceURL != "" {
+		progress.Stage(stageDownloading)
+		if err := downloadSource(ctx, job.SourceURL, inputPath); err != nil {
+			return err
+		}
+		log.Printf("🌐 Imported source for video ID %d", job.VideoID)
+	}
+
+	if w.scanner != nil {
+		progress.Stage(stageScanning)
+		if err := w.scanSource(ctx, job, inputPath); err != nil {
+			return err
+		}
+	}
+
+	progress.Stage(stageProbing)
+	src, err := w.transcoder.Probe(ctx, inputPath)
+	if err != nil {
+		return err
+	}
+	if err := saveMediaMetadata(w.db, job.VideoID, src); err != nil {
+		return retryableError("could not save media metadata", err)
+	}
+
+	profile := lookupProfile(job.Profile)
+	renditions := buildLadder(src, profile)
+	format := job.OutputFormat
+	if format != FormatCMAF {
+		format = FormatHLS
+	}
+	keyInfo := ""
+	if w.contentKeys != nil {
+		// ffmpeg's DASH muxer cannot encrypt segments, and publishing them in
+		// the clear would bypass content protection.
+		if format == FormatCMAF {
+			return permanentError("CMAF output is not available while encryption is enabled", errCMAFEncryption)
+		}
+		keyDir, err := os.MkdirTemp(w.scratchDir, fmt.Sprintf("key-%d-*", job.VideoID))
+		if err != nil {
+			return retryableError("could not create scratch directory", err)
+		}
+		defer os.RemoveAll(keyDir)
+		if keyInfo, err = w.prepareContentKey(job.VideoID, keyDir); err != nil {
+			return retryableError("could not create content key", err)
+		}
+	}
+	var overlay Overlay
+	if job.Watermark || job.WatermarkText != "" {
+		if format == FormatCMAF {
+			return permanentError("CMAF output is not available for watermarked videos", errCMAFWatermark)
+		}
+		overlayDir, err := os.MkdirTemp(w.scratchDir, fmt.Sprintf("overlay-%d-*", job.VideoID))
+		if err != nil {
+			return retryableError("could not create scratch directory", err)
+		}
+		defer os.RemoveAll(overlayDir)
+		var wm *Watermark
+		if job.Watermark {
+			if wm, err = loadWatermark(w.db, job.UserID); err != nil {
+				return retryableError("could not load watermark", err)
+			}
+			if wm == nil {
+				// Removed since the upload; the video is still worth publishing.
+				log.Printf("⚠️ Watermark for video ID %d no longer exists, transcoding without it", job.VideoID)
+			}
+		}
+		if overlay, err = prepareOverlay(overlayDir, wm, job.WatermarkText); err != nil {
+			return retryableError("could not write watermark", err)
+		}
+		if !overlay.empty() {
+			renditions = append(renditions, previewLadder(renditions, job.WatermarkRenditions)...)
+		}
+	}
+	progress.Stage(stageTranscoding)
+	out, err := w.transcoder.Transcode(ctx, TranscodeSpec{
+		InputPath:   inputPath,
+		OutputDir:   outputDir,
+		Source:      src,
+		Renditions:  renditions,
+		Profile:     profile,
+		Format:      format,
+		KeyInfoFile: keyInfo,
+		Overlay:     overlay,
+	}, progress.Update)
+	if err != nil {
+		return err
+	}
+	if err := writeMasterPlaylist(outputDir, renditions, profile, src.AudioTracks, format); err != nil {
+		return retryableError("could not write master playlist", err)
+	}
+	if err := w.addCaptions(ctx, job, inputPath, outputDir, src, format == FormatCMAF || profile.needsFMP4()); err != nil {
+		return err
+	}
+	log.Printf("🎬 Video processed: %s (%d renditions, %d files)", job.Filename, len(renditions), len(out.Files))
+
+	// Images are nice to have; a failure here should not fail the video.
+	progress.Stage(stageImages)
+	images, err := w.transcoder.Images(ctx, inputPath, outputDir, src, overlay)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Printf("⚠️ Failed to generate images for video ID %d: %v", job.VideoID, err)
+	}
+
+	progress.Stage(stageUploading)
+	if err := w.uploadOutput(ctx, job.VideoID, outputDir, s3KeyPrefix, progress); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return retryableError("could not upload renditions", err)
+	}
+	log.Printf("☁️ Uploaded all files for %s to S3", job.Filename)
+
+	if err := saveVideoImages(w.db, job.VideoID, s3KeyPrefix, images); err != nil {
+		return retryableError("could not save video images", err)
+	}
+
+	playlistS3Key := filepath.Join(s3KeyPrefix, masterPlaylistName)
+	dashS3Key := ""
+	if format == FormatCMAF {
+		dashS3Key = filepath.Join(s3KeyPrefix, dashManifestName)
+	}
+	previewS3Key := ""
+	if !overlay.empty() {
+		previewS3Key = filepath.Join(s3KeyPrefix, previewPlaylistName)
+	}
+	err = markVideoReady(w.db, job.VideoID, playlistS3Key, dashS3Key, previewS3Key)
+	if err != nil {
+		return retryableError("could not update video record", err)
+	}
+	w.rdb.Del(context.WithoutCancel(ctx), uploadManifestKey(job.VideoID))
+	log.Printf("✅ Metadata updated in DB for: %s", job.Filename)
+	return nil
+}
+
+// prepareContentKey creates the video's content key and writes ffmpeg's key
+// info file into keyDir, which lives outside the job's output directory so
+// the key is never uploaded.
+func (w *Worker) prepareContentKey(videoID int, keyDir string) (string, error) {
+	key, err := w.contentKeys.Create(w.db, videoID)
+	if err != nil {
+		return "", err
+	}
+	return w.contentKeys.writeKeyInfo(keyDir, videoID, key)
+}
+
+// maxImportBytes caps the size of an imported source, which lands on the
+// shared uploads volume before it is scanned or probed.
+var maxImportBytes = int64(envInt("MAX_UPLOAD_MB", 10240)) << 20
+
+var errForbiddenAddress = errors.New("address is not publicly routable")
+
+// importClient only connects to public addresses. The check runs on every
+// connection after DNS resolution, so redirects and rebinding cannot reach
+// the metadata service, Redis, Postgres or anything else on the host network.
+var importClient = &http.Client{
+	Timeout: 2 * time.Hour,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("%s: %w", host, errForbiddenAddress)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %s URL: %w", req.URL.Scheme, errForbiddenAddress)
+		}
+		return nil
+	},
+}
+
+// carrierGradeNAT is the shared address space of RFC 6598, which net.IP does
+// not treat as private.
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || carrierGradeNAT.Contains(ip))
+}
+
+// downloadSource fetches an imported video into the shared upload directory.
+// Client errors from the remote server, private addresses and oversized
+// sources are permanent; anything else may be retried.
+func downloadSource(ctx context.Context, sourceURL, dst string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return permanentError("source URL is invalid", err)
+	}
+	resp, err := importClient.Do(req)
+	if errors.Is(err, errForbiddenAddress) {
+		return permanentError("source URL does not point to a public address", err)
+	}
+	if err != nil {
+		return retryableError("could not download source", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status %s", resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError("source URL could not be downloaded", err)
+		}
+		return retryableError("could not download source", err)
+	}
+	tooLarge := permanentError("source is too large", fmt.Errorf("larger than %d MB", maxImportBytes>>20))
+	if resp.ContentLength > maxImportBytes {
+		return tooLarge
+	}
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return retryableError("could not store source", err)
+	}
+	defer file.Close()
+	n, err := io.Copy(file, io.LimitReader(resp.Body, maxImportBytes+1))
+	if err != nil {
+		return retryableError("could not download source", err)
+	}
+	if n > maxImportBytes {
+		file.Close()
+		os.Remove(dst)
+		return tooLarge
+	}
+	return nil
+}
+
+// quarantineDir lives on the shared uploads volume so quarantining is a rename.
+const quarantineDir = "/app/uploads/.quarantine"
+
+// scanSource runs the source through clamd. Infected files are moved to
+// quarantine, the owner is notified and a rejection is returned. If clamd is
+// unreachable the job is retried rather than processed unscanned.
+func (w *Worker) scanSource(ctx context.Context, job VideoJob, inputPath string) error {
+	file, err := os.Open(inputPath)
+	if err != nil {
+		return permanentError("source file is missing", err)
+	}
+	result, err := w.scanner.Scan(ctx, file)
+	file.Close()
+	if err == ErrScanLimitExceeded {
+		return permanentError("file is too large to be scanned", err)
+	}
+	if err != nil {
+		return retryableError("malware scan could not be completed", err)
+	}
+	if !result.Infected {
+		log.Printf("🛡️ Scan clean for video ID %d", job.VideoID)
+		return nil
+	}
+
+	log.Printf("☣️ Video ID %d is infected with %s, quarantining", job.VideoID, result.Signature)
+	os.MkdirAll(quarantineDir, 0o700)
+	quarantinePath := filepath.Join(quarantineDir, fmt.Sprintf("%d-%s", job.VideoID, job.Filename))
+	if err := os.Rename(inputPath, quarantinePath); err != nil {
+		log.Printf("❌ Failed to quarantine %s, deleting it instead: %v", inputPath, err)
+		os.Remove(inputPath)
+	}
+
+	msg := fmt.Sprintf("Your upload %q was rejected because it contains malware (%s).", job.Filename, result.Signature)
+	if err := notifyOwner(w.db, job.VideoID, "video_rejected", msg); err != nil {
+		log.Printf("❌ Failed to notify owner of video ID %d: %v", job.VideoID, err)
+	}
+	return rejectedError("malware detected: " + result.Signature)
+}
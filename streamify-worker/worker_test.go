@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testWorker is a Worker wired to a fake database, an in-memory Redis,
+// local storage and the fake transcoder.
+type testWorker struct {
+	*Worker
+	db      *fakeDB
+	redis   *miniredis.Miniredis
+	storage string
+	job     VideoJob
+}
+
+func newTestWorker(t *testing.T, transcoder *FakeTranscoder) *testWorker {
+	t.Helper()
+	db, fake := newFakeDB(t)
+	fake.setRows("SELECT status FROM videos", []driver.Value{"processing"})
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	storageDir := t.TempDir()
+	storage, err := newLocalStorage(storageDir, "http://media.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := uploadsDir
+	uploadsDir = t.TempDir()
+	t.Cleanup(func() { uploadsDir = dir })
+	job := VideoJob{VideoID: 42, Filename: "clip.mp4", Profile: "standard", UserID: 7}
+	if err := os.WriteFile(sourcePath(job), []byte("fake source"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testWorker{
+		Worker: &Worker{
+			db:         db,
+			rdb:        rdb,
+			queue:      NewQueue(rdb),
+			retry:      RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute},
+			limits:     Limits{Jobs: 1, FFmpeg: 1, S3Uploads: 2},
+			uploads:    newSemaphore(2),
+			storage:    storage,
+			transcoder: transcoder,
+			ffmpeg:     &ffmpegRunner{slots: newSemaphore(1)},
+			scratchDir: t.TempDir(),
+			cancels:    newCancellations(),
+			upload:     UploadPolicy{MaxAttempts: 1, BaseDelay: time.Millisecond},
+		},
+		db:      fake,
+		redis:   mr,
+		storage: storageDir,
+		job:     job,
+	}
+}
+
+// statusUpdates returns the statuses set by setVideoStatusReason.
+func (w *testWorker) statusUpdates() []string {
+	var statuses []string
+	for _, e := range w.db.execsLike("SET status = $1, status_reason = $2") {
+		statuses = append(statuses, e.Args[0].(string))
+	}
+	return statuses
+}
+
+func (w *testWorker) sourceExists() bool {
+	_, err := os.Stat(sourcePath(w.job))
+	return err == nil
+}
+
+func (w *testWorker) delayedJobs(t *testing.T) []VideoJob {
+	t.Helper()
+	if !w.redis.Exists(delayedQueue) {
+		return nil
+	}
+	members, err := w.redis.ZMembers(delayedQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs []VideoJob
+	for _, m := range members {
+		var job VideoJob
+		if err := json.Unmarshal([]byte(m), &job); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func (w *testWorker) deadLetters(t *testing.T) []DeadLetter {
+	t.Helper()
+	if !w.redis.Exists(deadLetterQueue) {
+		return nil
+	}
+	items, err := w.redis.List(deadLetterQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letters []DeadLetter
+	for _, item := range items {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(item), &letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func TestHandleJobSuccess(t *testing.T) {
+	w := newTestWorker(t, &FakeTranscoder{})
+	if err := w.handleJob(context.Background(), w.job); err != nil {
+		t.Fatalf("handleJob() error = %v", err)
+	}
+
+	ready := w.db.execsLike("SET status = 'ready'")
+	if len(ready) != 1 {
+		t.Fatalf("video marked ready %d times, want once", len(ready))
+	}
+	if got, want := ready[0].Args[0], "videos/42/clip.mp4/master.m3u8"; got != want {
+		t.Errorf("s3_key = %v, want %s", got, want)
+	}
+	for _, key := range []string{"videos/42/clip.mp4/master.m3u8", "videos/42/clip.mp4/images/poster.jpg"} {
+		if _, err := os.Stat(filepath.Join(w.storage, key)); err != nil {
+			t.Errorf("%s was not stored: %v", key, err)
+		}
+	}
+	if statuses := w.statusUpdates(); len(statuses) != 0 {
+		t.Errorf("status set to %v, want no failure status", statuses)
+	}
+	if w.sourceExists() {
+		t.Error("source was kept after the video became ready")
+	}
+	if w.redis.Exists(jobLockKey(w.job.VideoID)) {
+		t.Error("video lock was not released")
+	}
+}
+
+func TestHandleJobRetryableFailure(t *testing.T) {
+	w := newTestWorker(t, &FakeTranscoder{Err: retryableError("encoder crashed", errors.New("signal: killed"))})
+	if err := w.handleJob(context.Background(), w.job); err != nil {
+		t.Fatalf("handleJob() error = %v", err)
+	}
+
+	delayed := w.delayedJobs(t)
+	if len(delayed) != 1 {
+		t.Fatalf("%d jobs scheduled for retry, want 1", len(delayed))
+	}
+	if delayed[0].VideoID != w.job.VideoID || delayed[0].Attempt != 1 || delayed[0].LastError == "" {
+		t.Errorf("scheduled job = %+v, want attempt 1 of video 42 with its last error", delayed[0])
+	}
+	if letters := w.deadLetters(t); len(letters) != 0 {
+		t.Errorf("%d jobs dead-lettered, want none", len(letters))
+	}
+	if statuses := w.statusUpdates(); len(statuses) != 0 {
+		t.Errorf("status set to %v, want it left processing", statuses)
+	}
+	if !w.sourceExists() {
+		t.Error("source was removed before the retry")
+	}
+}
+
+func TestHandleJobRetriesExhausted(t *testing.T) {
+	w := newTestWorker(t, &FakeTranscoder{Err: retryableError("encoder crashed", errors.New("signal: killed"))})
+	w.job.Attempt = w.retry.MaxAttempts - 1
+	if err := w.handleJob(context.Background(), w.job); err != nil {
+		t.Fatalf("handleJob() error = %v", err)
+	}
+
+	if delayed := w.delayedJobs(t); len(delayed) != 0 {
+		t.Errorf("%d jobs scheduled for retry, want none", len(delayed))
+	}
+	letters := w.deadLetters(t)
+	if len(letters) != 1 || letters[0].Job.VideoID != w.job.VideoID {
+		t.Fatalf("dead letters = %+v, want the job for video 42", letters)
+	}
+	if statuses := w.statusUpdates(); len(statuses) != 1 || statuses[0] != "failed" {
+		t.Errorf("status set to %v, want [failed]", statuses)
+	}
+	if !w.sourceExists() {
+		t.Error("source was removed, so the dead letter cannot be replayed")
+	}
+}
+
+func TestHandleJobPermanentFailure(t *testing.T) {
+	w := newTestWorker(t, &FakeTranscoder{Err: permanentError("source is not a readable video", errors.New("invalid data"))})
+	if err := w.handleJob(context.Background(), w.job); err != nil {
+		t.Fatalf("handleJob() error = %v", err)
+	}
+
+	if statuses := w.statusUpdates(); len(statuses) != 1 || statuses[0] != "failed" {
+		t.Errorf("status set to %v, want [failed]", statuses)
+	}
+	if delayed := w.delayedJobs(t); len(delayed) != 0 {
+		t.Errorf("%d jobs scheduled for retry, want none", len(delayed))
+	}
+	if letters := w.deadLetters(t); len(letters) != 0 {
+		t.Errorf("%d jobs dead-lettered, want none", len(letters))
+	}
+	if w.sourceExists() {
+		t.Error("source was kept after a permanent failure")
+	}
+}
+
+// startSlowJob runs a job that takes far longer than the test and returns
+// once it is transcoding.
+func startSlowJob(t *testing.T, w *testWorker, ctx context.Context) <-chan error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() { result <- w.handleJob(ctx, w.job) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.cancels.active()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("job never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return result
+}
+
+func TestHandleJobShutdown(t *testing.T) {
+	w := newTestWorker(t, &FakeTranscoder{Duration: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	result := startSlowJob(t, w, ctx)
+	cancel()
+
+	if err := <-result; !errors.Is(err, errJobInterrupted) {
+		t.Fatalf("handleJob() error = %v, want errJobInterrupted", err)
+	}
+	if statuses := w.statusUpdates(); len(statuses) != 0 {
+		t.Errorf("status set to %v, want it left processing", statuses)
+	}
+	if delayed := w.delayedJobs(t); len(delayed) != 0 {
+		t.Errorf("%d jobs scheduled for retry, want the job requeued untouched", len(delayed))
+	}
+	if !w.sourceExists() {
+		t.Error("source was removed from an interrupted job")
+	}
+}
+
+func TestHandleJobVideoDeleted(t *testing.T) {
+	w := newTestWorker(t, &FakeTranscoder{Duration: time.Minute})
+	stale := filepath.Join(w.storage, "videos/42/clip.mp4/old.ts")
+	if err := os.MkdirAll(filepath.Dir(stale), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("partial upload"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	result := startSlowJob(t, w, context.Background())
+	w.cancels.cancel(w.job.VideoID)
+
+	if err := <-result; err != nil {
+		t.Fatalf("handleJob() error = %v, want the cancelled job acknowledged", err)
+	}
+	if statuses := w.statusUpdates(); len(statuses) != 0 {
+		t.Errorf("status set to %v for a deleted video", statuses)
+	}
+	if w.sourceExists() {
+		t.Error("source of the deleted video was kept")
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stored files of the deleted video were kept")
+	}
+}
+
+func TestHandleJobWatermarkKeepsCleanMaster(t *testing.T) {
+	w := newTestWorker(t, &FakeTranscoder{})
+	w.job.WatermarkText = "reviewer@example.com"
+	w.job.WatermarkRenditions = []string{"360p"}
+	if err := w.handleJob(context.Background(), w.job); err != nil {
+		t.Fatalf("handleJob() error = %v", err)
+	}
+
+	master, err := os.ReadFile(filepath.Join(w.storage, "videos/42/clip.mp4/master.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(master), "_wm") || !strings.Contains(string(master), "360p/playlist.m3u8") {
+		t.Errorf("master playlist =\n%s\nwant only the clean renditions", master)
+	}
+	preview, err := os.ReadFile(filepath.Join(w.storage, "videos/42/clip.mp4/preview.m3u8"))
+	if err != nil {
+		t.Fatalf("preview playlist was not stored: %v", err)
+	}
+	if !strings.Contains(string(preview), "360p_wm/playlist.m3u8") || strings.Contains(string(preview), "720p") || strings.Contains(string(preview), "480p") {
+		t.Errorf("preview playlist =\n%s\nwant only the watermarked 360p rendition", preview)
+	}
+	ready := w.db.execsLike("SET status = 'ready'")
+	if len(ready) != 1 || ready[0].Args[2] != "videos/42/clip.mp4/preview.m3u8" {
+		t.Errorf("ready update = %+v, want the preview playlist recorded", ready)
+	}
+}